@@ -0,0 +1,259 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/ninjasphere/go-zigbee/gateway"
+)
+
+// ACEChannel receives the commands of a security keypad or keyfob (the client side of the IAS ACE cluster),
+// and sends them as events. We act as the panel, keeping the arm state in the driver config.
+type ACEChannel struct {
+	Channel
+	SendEvent func(event string, payload ...interface{}) error
+}
+
+func init() {
+	registerClusterHandler(&clusterHandler{
+		name:      "ias-ace",
+		clusterID: ClusterIDIASACE,
+		direction: clusterOutput,
+		idSuffix:  "-out",
+		newChannel: func(channel Channel) clusterChannel {
+			return &ACEChannel{Channel: channel}
+		},
+	})
+}
+
+// aceConfig is the state of the panel that keypads and keyfobs arm and disarm
+type aceConfig struct {
+	// The codes accepted to arm or disarm. If there are none, arming doesn't check the code (keyfobs don't send
+	// one), but disarming is refused.
+	Codes []string
+
+	PanelStatus string // one of the keys of panelStatuses
+}
+
+// Commands sent to us by the device
+const (
+	ACECommandArm            uint32 = 0x00
+	ACECommandBypass         uint32 = 0x01
+	ACECommandEmergency      uint32 = 0x02
+	ACECommandFire           uint32 = 0x03
+	ACECommandPanic          uint32 = 0x04
+	ACECommandGetPanelStatus uint32 = 0x07
+)
+
+// Commands we send back
+const (
+	ACECommandArmResponse            uint32 = 0x00
+	ACECommandGetPanelStatusResponse uint32 = 0x05
+)
+
+// The arm modes of the Arm command
+var armModes = map[byte]string{
+	0x00: "disarm",
+	0x01: "arm-day",
+	0x02: "arm-night",
+	0x03: "arm-all",
+}
+
+// The panel status after each arm mode
+var armModeStatuses = map[string]string{
+	"disarm":    "disarmed",
+	"arm-day":   "armed-stay",
+	"arm-night": "armed-night",
+	"arm-all":   "armed-away",
+}
+
+// Arm notifications sent in the Arm Response
+const (
+	armNotificationDisarmed        = 0x00
+	armNotificationDayArmed        = 0x01
+	armNotificationNightArmed      = 0x02
+	armNotificationAllArmed        = 0x03
+	armNotificationInvalidCode     = 0x04
+	armNotificationAlreadyDisarmed = 0x06
+)
+
+var armNotifications = map[string]byte{
+	"disarm":    armNotificationDisarmed,
+	"arm-day":   armNotificationDayArmed,
+	"arm-night": armNotificationNightArmed,
+	"arm-all":   armNotificationAllArmed,
+}
+
+var panelStatuses = map[string]byte{
+	"disarmed":     0x00,
+	"armed-stay":   0x01,
+	"armed-night":  0x02,
+	"armed-away":   0x03,
+	"exit-delay":   0x04,
+	"entry-delay":  0x05,
+	"not-ready":    0x06,
+	"in-alarm":     0x07,
+	"arming-stay":  0x08,
+	"arming-night": 0x09,
+	"arming-away":  0x0A,
+}
+
+// ACEEvent is the payload of the events sent by the channel
+type ACEEvent struct {
+	Device string `json:"device"` // the IEEE address of the keypad or keyfob
+	Mode   string `json:"mode,omitempty"`
+	ZoneID *int   `json:"zoneId,omitempty"`
+}
+
+func (c *ACEChannel) SetEventHandler(handler func(event string, payload ...interface{}) error) {
+	c.SendEvent = handler
+}
+
+func (c *ACEChannel) GetProtocol() string {
+	return "ias-ace"
+}
+
+func (c *ACEChannel) init() error {
+	log.Debugf("Initialising IAS ACE channel of device %X", *c.device.deviceInfo.IeeeAddress)
+
+	err := c.device.driver.Conn.ExportChannel(c.device, c, c.ID)
+	if err != nil {
+		log.Fatalf("Failed to announce IAS ACE channel: %s", err)
+	}
+
+	go func() {
+		for frame := range c.bindCluster(ClusterIDIASACE) {
+			if frame.GetClientServerDirection() != gateway.GwClientServerDirT_CLIENT_TO_SERVER {
+				continue
+			}
+			if err := c.handleCommand(frame); err != nil {
+				log.Warningf("Failed to handle IAS ACE command 0x%X from device %X: %s", frame.GetCommandId(), *c.device.deviceInfo.IeeeAddress, err)
+			}
+		}
+	}()
+
+	return nil
+}
+
+// SetPanelStatus sets the arm state we report to keypads, e.g. when it is changed by the alarm app.
+func (c *ACEChannel) SetPanelStatus(status string) error {
+	if _, ok := panelStatuses[status]; !ok {
+		return fmt.Errorf("Unknown panel status '%s'", status)
+	}
+	c.device.driver.setPanelStatus(status)
+	return nil
+}
+
+func (c *ACEChannel) handleCommand(frame *gateway.GwZclFrameReceiveInd) error {
+
+	event := &ACEEvent{
+		Device: fmt.Sprintf("%X", *c.device.deviceInfo.IeeeAddress),
+	}
+
+	switch frame.GetCommandId() {
+	case ACECommandArm:
+		return c.arm(frame, event)
+	case ACECommandEmergency:
+		return c.SendEvent("emergency", event)
+	case ACECommandFire:
+		return c.SendEvent("fire", event)
+	case ACECommandPanic:
+		return c.SendEvent("panic", event)
+	case ACECommandGetPanelStatus:
+		return c.sendPanelStatus(frame)
+	}
+
+	log.Debugf("Ignoring IAS ACE command 0x%X from device %X", frame.GetCommandId(), *c.device.deviceInfo.IeeeAddress)
+	return nil
+}
+
+// arm handles the Arm command: arm mode, arm/disarm code (a ZCL string) and zone ID
+func (c *ACEChannel) arm(frame *gateway.GwZclFrameReceiveInd, event *ACEEvent) error {
+
+	payload := frame.Payload
+	if len(payload) < 1 {
+		return fmt.Errorf("Arm command is too short")
+	}
+
+	mode, ok := armModes[payload[0]]
+	if !ok {
+		return fmt.Errorf("Unknown arm mode 0x%X", payload[0])
+	}
+	event.Mode = mode
+
+	// A length of 0xFF is an invalid (empty) string, and we don't guess where the zone ID is after one
+	code := ""
+	if len(payload) > 1 && payload[1] != 0xFF {
+		length := int(payload[1])
+		if len(payload) < 2+length {
+			return fmt.Errorf("Arm code is longer than the arm command")
+		}
+		code = string(payload[2 : 2+length])
+
+		if len(payload) > 2+length {
+			zoneID := int(payload[2+length])
+			event.ZoneID = &zoneID
+		}
+	}
+
+	if !c.device.driver.validArmCode(mode, code) {
+		log.Warningf("Invalid arm code from device %X", *c.device.deviceInfo.IeeeAddress)
+		c.SendEvent("invalid-code", event)
+		return c.sendResponse(frame, ACECommandArmResponse, []byte{armNotificationInvalidCode})
+	}
+
+	notification := armNotifications[mode]
+	if mode == "disarm" && c.device.driver.panelStatus() == "disarmed" {
+		notification = armNotificationAlreadyDisarmed
+	}
+
+	c.device.driver.setPanelStatus(armModeStatuses[mode])
+
+	name := "arm"
+	if mode == "disarm" {
+		name = "disarm"
+	}
+	c.SendEvent(name, event)
+
+	return c.sendResponse(frame, ACECommandArmResponse, []byte{notification})
+}
+
+// sendPanelStatus answers Get Panel Status: panel status, seconds remaining, audible notification and alarm status
+func (c *ACEChannel) sendPanelStatus(frame *gateway.GwZclFrameReceiveInd) error {
+	status := panelStatuses[c.device.driver.panelStatus()]
+	return c.sendResponse(frame, ACECommandGetPanelStatusResponse, []byte{status, 0x00, 0x01, 0x00})
+}
+
+// validArmCode returns whether a code may be used to arm or disarm. Without any codes configured, only arming is
+// allowed, so that a keyfob can't disarm the panel.
+func (d *Driver) validArmCode(mode, code string) bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if len(d.driverConfig.ACE.Codes) == 0 {
+		return mode != "disarm"
+	}
+	for _, valid := range d.driverConfig.ACE.Codes {
+		if code == valid {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *Driver) panelStatus() string {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if d.driverConfig.ACE.PanelStatus == "" {
+		return "disarmed"
+	}
+	return d.driverConfig.ACE.PanelStatus
+}
+
+func (d *Driver) setPanelStatus(status string) {
+	d.lock.Lock()
+	d.driverConfig.ACE.PanelStatus = status
+	d.lock.Unlock()
+
+	d.saveConfig()
+}
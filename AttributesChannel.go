@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/ninjasphere/go-zigbee/gateway"
+)
+
+// How many attributes we ask for in each read, to keep the responses a reasonable size
+const attributesPerRead = 8
+
+// AttributesChannel publishes the raw attributes of a cluster we don't have a handler for, so that
+// new hardware can at least be observed before proper support for it is added.
+// The state is a map of attribute ID (e.g. "0x0000") to its decoded value.
+type AttributesChannel struct {
+	Channel
+	clusterID  uint32
+	attributes []uint32
+	lastState  map[string]interface{}
+	SendEvent  func(event string, payload ...interface{}) error
+}
+
+// Clusters that are there to run the device and the network rather than to tell us anything about it
+var infrastructureClusters = []uint32{
+	ClusterIDBasic,
+	0x0003, // Identify
+	0x0004, // Groups
+	0x0005, // Scenes
+	0x0009, // Alarms
+	0x000A, // Time
+	0x0019, // OTA Upgrade
+	0x0020, // Poll Control
+	0x0B05, // Diagnostics
+	0x1000, // ZLL Commissioning
+}
+
+func init() {
+	registerClusterHandler(&clusterHandler{
+		name:      "zigbee-attributes",
+		direction: clusterInput,
+		idSuffix:  "-attributes",
+		optional:  true,
+		newFallbackChannel: func(channel Channel, clusterID uint32) clusterChannel {
+			return &AttributesChannel{Channel: channel, clusterID: clusterID}
+		},
+		skipClusters: infrastructureClusters,
+	})
+}
+
+func (c *AttributesChannel) SetEventHandler(handler func(event string, payload ...interface{}) error) {
+	c.SendEvent = handler
+}
+
+func (c *AttributesChannel) GetProtocol() string {
+	return "zigbee-attributes"
+}
+
+func (c *AttributesChannel) init() error {
+	log.Debugf("Initialising attributes channel for cluster 0x%X of device %X", c.clusterID, *c.device.deviceInfo.IeeeAddress)
+
+	err := c.device.driver.Conn.ExportChannel(c.device, c, c.ID)
+	if err != nil {
+		log.Fatalf("Failed to announce attributes channel: %s", err)
+	}
+
+	go func() {
+		c.device.driver.waitUntilReady()
+
+		for {
+			err := c.discoverAttributes()
+			if err == nil {
+				break
+			}
+			log.Warningf("Failed to discover attributes of cluster 0x%X: %s", c.clusterID, err)
+			time.Sleep(1 * time.Minute)
+		}
+
+		if len(c.attributes) == 0 {
+			log.Debugf("Cluster 0x%X of device %X has no attributes to poll", c.clusterID, *c.device.deviceInfo.IeeeAddress)
+			return
+		}
+
+		for {
+			err := c.fetchState()
+			if err != nil {
+				log.Errorf("Failed to poll for attributes of cluster 0x%X: %s", c.clusterID, err)
+			}
+			time.Sleep(1 * time.Minute)
+		}
+	}()
+
+	return nil
+}
+
+// discoverAttributes finds which attributes the device has on the cluster.
+func (c *AttributesChannel) discoverAttributes() error {
+
+	attributes, err := c.device.discoverAttributes(c.dstAddress())
+	if err != nil {
+		return err
+	}
+
+	c.attributes = attributes[c.clusterID]
+
+	log.Debugf("Found %d attributes on cluster 0x%X of device %X", len(c.attributes), c.clusterID, *c.device.deviceInfo.IeeeAddress)
+
+	return nil
+}
+
+// discoverAttributes finds the attributes the device has on each of its clusters. The gateway does this
+// using ZCL Discover Attributes on the whole device, so it is only done once and shared by all of the
+// device's attributes channels.
+func (d *Device) discoverAttributes(dstAddress *gateway.GwAddressStructT) (map[uint32][]uint32, error) {
+	d.attributesLock.Lock()
+	defer d.attributesLock.Unlock()
+
+	if d.attributes != nil {
+		return d.attributes, nil
+	}
+
+	request := &gateway.GwGetDeviceAttributeListReq{
+		DstAddress: dstAddress,
+	}
+
+	response := &gateway.GwGetDeviceAttributeListRspInd{}
+	err := d.driver.gatewayConn.SendAsyncCommand(request, response, 20*time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("Error discovering attributes : %s", err)
+	}
+	if response.Status.String() != "STATUS_SUCCESS" {
+		return nil, fmt.Errorf("Failed to discover attributes. status: %s", response.Status.String())
+	}
+
+	d.attributes = make(map[uint32][]uint32)
+	for _, cluster := range response.ClusterList {
+		d.attributes[*cluster.ClusterId] = cluster.AttributeList
+	}
+
+	return d.attributes, nil
+}
+
+func (c *AttributesChannel) fetchState() error {
+
+	state := make(map[string]interface{})
+
+	for start := 0; start < len(c.attributes); start += attributesPerRead {
+		end := start + attributesPerRead
+		if end > len(c.attributes) {
+			end = len(c.attributes)
+		}
+
+		records, err := c.readAttributes(c.clusterID, c.attributes[start:end]...)
+		if err != nil {
+			return err
+		}
+
+		for id, record := range records {
+			state[fmt.Sprintf("0x%04X", id)] = decodeAttribute(record)
+		}
+	}
+
+	if !reflect.DeepEqual(state, c.lastState) {
+		c.lastState = state
+		c.SendEvent("state", state)
+	}
+
+	return nil
+}
@@ -1,6 +1,12 @@
 package main
 
-import "github.com/ninjasphere/go-ninja/devices"
+import (
+	"fmt"
+	"strings"
+
+	"github.com/ninjasphere/go-ninja/devices"
+	"github.com/ninjasphere/go-zigbee/gateway"
+)
 
 type BatchChannel struct {
 	Channel
@@ -9,6 +15,17 @@ type BatchChannel struct {
 	color      *ColorChannel
 }
 
+// batchError collects the failures of the individual commands sent for a single batch update.
+type batchError []error
+
+func (e batchError) Error() string {
+	messages := make([]string, len(e))
+	for i, err := range e {
+		messages[i] = err.Error()
+	}
+	return strings.Join(messages, "; ")
+}
+
 func (c *BatchChannel) init() error {
 	log.Debugf("Initialising batch channel of device %d", *c.device.deviceInfo.IeeeAddress)
 
@@ -20,23 +37,119 @@ func (c *BatchChannel) init() error {
 	return nil
 }
 
+// SetBatch applies a light state in as few commands as possible, all sharing the same transition.
+// Anything that already matches the last known state of the light is not sent.
 func (c *BatchChannel) SetBatch(state *devices.LightDeviceState) error {
 
-	if c.onOff != nil && state.OnOff != nil {
-		c.onOff.SetOnOff(*state.OnOff)
+	transition := transitionTime(state.Transition)
+
+	onOff := state.OnOff
+	if c.onOff == nil || (onOff != nil && c.onOff.lastState != nil && *c.onOff.lastState == *onOff) {
+		onOff = nil
+	}
+
+	brightness := state.Brightness
+	if c.brightness == nil || (brightness != nil && c.brightness.hasState(*brightness)) {
+		brightness = nil
+	}
+
+	color := state.Color
+	if c.color == nil || (color != nil && c.color.hasState(color)) {
+		color = nil
+	}
+	if color != nil && color.Mode != "hue" {
+		return fmt.Errorf("TODO: Only color mode 'hue' is supported atm.")
+	}
+
+	var errs batchError
+
+	// Each command goes through the channel's setter, so it replaces any set request of that channel that
+	// hasn't been sent yet rather than being overwritten by it.
+
+	if brightness != nil {
+		// If we're turning the light on, do it as part of the level change so it fades up from off
+		withOnOff := onOff != nil && *onOff && *brightness > 0
+		if withOnOff {
+			// An on/off request still waiting to be sent would undo this
+			c.onOff.setter.cancel()
+		}
+
+		err := c.brightness.setter.submit(func() {
+			c.brightness.lastCommanded = brightness
+			c.brightness.updateState(*brightness)
+		}, func() error {
+			return c.brightness.moveToLevel(*brightness, transition, withOnOff)
+		})
+		if err != nil {
+			errs = append(errs, err)
+		} else if withOnOff {
+			on := onOff
+			c.onOff.setter.update(func() {
+				c.onOff.lastCommanded = on
+				c.onOff.updateState(true)
+			})
+			onOff = nil
+		}
 	}
 
-	if c.brightness != nil && state.Brightness != nil {
-		c.brightness.SetBrightness(*state.Brightness)
+	if onOff != nil {
+		state := gateway.GwOnOffStateT_OFF_STATE
+		if *onOff {
+			state = gateway.GwOnOffStateT_ON_STATE
+		}
+
+		on := onOff
+		err := c.onOff.setter.submit(func() {
+			c.onOff.lastCommanded = on
+			c.onOff.updateState(*on)
+		}, func() error {
+			return c.onOff.sendState(state.Enum())
+		})
+		if err != nil {
+			errs = append(errs, err)
+		}
 	}
 
-	if c.color != nil && state.Color != nil {
-		c.color.SetColor(state.Color)
+	// Many lights ignore color changes while they're off, so the color goes last
+	if color != nil {
+		err := c.color.setter.submit(func() {
+			c.color.updateCommanded(color)
+		}, func() error {
+			return c.color.moveToHueAndSaturation(color, transition)
+		})
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if len(errs) > 0 {
+		return errs
 	}
 
 	return nil
 }
 
+func (c *BatchChannel) Move(params *LevelMove) error {
+	if c.brightness == nil {
+		return fmt.Errorf("This device does not support changing brightness")
+	}
+	return c.brightness.move(params)
+}
+
+func (c *BatchChannel) Step(params *LevelStep) error {
+	if c.brightness == nil {
+		return fmt.Errorf("This device does not support changing brightness")
+	}
+	return c.brightness.step(params)
+}
+
+func (c *BatchChannel) Stop(params *LevelStop) error {
+	if c.brightness == nil {
+		return fmt.Errorf("This device does not support changing brightness")
+	}
+	return c.brightness.stop(params)
+}
+
 func (c *BatchChannel) GetProtocol() string {
 	return "core/batching"
 }
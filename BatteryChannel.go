@@ -0,0 +1,336 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ninjasphere/go-zigbee/gateway"
+	"github.com/ninjasphere/go-zigbee/nwkmgr"
+)
+
+// BatteryChannel publishes the battery level of a device from its Power Configuration cluster. Devices that
+// report the percentage remaining use that, otherwise it is estimated from the voltage.
+type BatteryChannel struct {
+	Channel
+	sync.Mutex
+	attributes map[uint32]*gateway.GwAttributeRecordT // the last value of each attribute, from a poll or report
+	lastState  *BatteryState
+	low        bool
+	SendEvent  func(event string, payload ...interface{}) error
+}
+
+func init() {
+	registerClusterHandler(&clusterHandler{
+		name:      "battery",
+		clusterID: ClusterIDPowerConfiguration,
+		direction: clusterInput,
+		interview: interviewBattery,
+		newChannel: func(channel Channel) clusterChannel {
+			return &BatteryChannel{Channel: channel}
+		},
+	})
+}
+
+// Attributes of the Power Configuration cluster
+const (
+	PowerConfigAttributeBatteryVoltage             uint32 = 0x0020 // 100mV
+	PowerConfigAttributeBatteryPercentageRemaining uint32 = 0x0021 // half percent
+	PowerConfigAttributeBatterySize                uint32 = 0x0031
+	PowerConfigAttributeBatteryQuantity            uint32 = 0x0033
+)
+
+// batteryConfig can be set for a model or a device (which takes precedence)
+type batteryConfig struct {
+	Type       string   // one of the keys of batteryCurves. Read from the device's BatterySize if not set.
+	Cells      int      // the number of cells in series. Read from the device's BatteryQuantity if not set.
+	LowBattery *float64 // the percentage below which the "low-battery" event is sent (default 20)
+}
+
+const defaultLowBattery = 20.0
+
+// BatteryState is sent as the channel's state
+type BatteryState struct {
+	Percentage *float64 `json:"percentage,omitempty"` // 0-100
+	Voltage    *float64 `json:"voltage,omitempty"`    // volts
+}
+
+type batteryPoint struct {
+	voltage    float64 // per cell
+	percentage float64
+}
+
+// Approximate discharge curves of each battery type, from full to flat
+var batteryCurves = map[string][]batteryPoint{
+	"cr2032": {{3.0, 100}, {2.9, 80}, {2.8, 60}, {2.7, 40}, {2.6, 20}, {2.5, 10}, {2.0, 0}}, // lithium coin cells
+	"cr123a": {{3.0, 100}, {2.9, 60}, {2.8, 30}, {2.6, 10}, {2.0, 0}},                       // lithium (also CR2)
+	"aa":     {{1.55, 100}, {1.4, 70}, {1.3, 40}, {1.2, 20}, {1.1, 5}, {1.0, 0}},            // alkaline (also AAA, C and D)
+}
+
+// The curve used for each BatterySize
+var batterySizes = map[uint64]string{
+	0x03: "aa",     // AA
+	0x04: "aa",     // AAA
+	0x05: "aa",     // C
+	0x06: "aa",     // D
+	0x07: "cr123a", // CR2
+	0x08: "cr123a", // CR123A
+}
+
+func (c *BatteryChannel) SetEventHandler(handler func(event string, payload ...interface{}) error) {
+	c.SendEvent = handler
+}
+
+func (c *BatteryChannel) GetProtocol() string {
+	return "battery"
+}
+
+// interviewBattery finds whether the device has a battery at all. Mains powered devices often have the Power
+// Configuration cluster without any of the battery attributes.
+func interviewBattery(device *Device, endpoint *nwkmgr.NwkSimpleDescriptorT) error {
+
+	channel := &Channel{
+		device:   device,
+		endpoint: endpoint,
+	}
+
+	attributes, err := channel.readAttributes(ClusterIDPowerConfiguration, PowerConfigAttributeBatteryVoltage, PowerConfigAttributeBatteryPercentageRemaining)
+	if err != nil {
+		// Without an answer we export the channel anyway, as we did before
+		log.Infof("Failed to read battery attributes of device %X: %s", *device.deviceInfo.IeeeAddress, err)
+		return nil
+	}
+
+	device.driver.updateDeviceConfig(*device.deviceInfo.IeeeAddress, func(cfg *deviceConfig) {
+		cfg.NoBattery = len(attributes) == 0
+	})
+
+	return nil
+}
+
+func (c *BatteryChannel) init() error {
+	log.Debugf("Initialising battery channel of device %X", *c.device.deviceInfo.IeeeAddress)
+
+	if cfg, _ := c.device.config(); cfg.NoBattery {
+		log.Debugf("Device %X doesn't report a battery voltage or percentage. Not exporting a battery channel", *c.device.deviceInfo.IeeeAddress)
+		return nil
+	}
+
+	err := c.device.driver.Conn.ExportChannel(c.device, c, c.ID)
+	if err != nil {
+		log.Fatalf("Failed to announce battery channel: %s", err)
+	}
+
+	state := &BatteryState{}
+	if c.cachedState(state) {
+		c.lastState = state
+		c.low = state.Percentage != nil && *state.Percentage < c.lowBattery(c.config())
+		sendCachedState(c.SendEvent, state)
+	}
+
+	go func() {
+		c.device.driver.waitUntilReady()
+		c.enableReporting()
+		go c.handleReports()
+
+		for {
+			err := c.fetchState()
+			if err != nil {
+				log.Errorf("Failed to poll for battery level %s", err)
+			}
+			time.Sleep(1 * time.Hour)
+		}
+	}()
+
+	return nil
+}
+
+// enableReporting asks the device to report its battery voltage and percentage. Battery powered devices are
+// usually asleep, so they are only asked to report rarely.
+func (c *BatteryChannel) enableReporting() {
+
+	clusterID := ClusterIDPowerConfiguration
+	voltageAttributeID := PowerConfigAttributeBatteryVoltage
+	percentageAttributeID := PowerConfigAttributeBatteryPercentageRemaining
+	minReportInterval := uint32(3600)
+	maxReportInterval := uint32(21600)
+	reportableVoltageChange := uint32(1)    // 100mV
+	reportablePercentageChange := uint32(2) // 1%
+
+	request := &gateway.GwSetAttributeReportingReq{
+		DstAddress: c.dstAddress(),
+		ClusterId:  &clusterID,
+		AttributeReportList: []*gateway.GwAttributeReportT{{
+			AttributeId:       &voltageAttributeID,
+			AttributeType:     gateway.GwZclAttributeDataTypesT_ZCL_DATATYPE_UINT8.Enum(),
+			MinReportInterval: &minReportInterval,
+			MaxReportInterval: &maxReportInterval,
+			ReportableChange:  &reportableVoltageChange,
+		}, {
+			AttributeId:       &percentageAttributeID,
+			AttributeType:     gateway.GwZclAttributeDataTypesT_ZCL_DATATYPE_UINT8.Enum(),
+			MinReportInterval: &minReportInterval,
+			MaxReportInterval: &maxReportInterval,
+			ReportableChange:  &reportablePercentageChange,
+		}},
+	}
+
+	response := &gateway.GwSetAttributeReportingRspInd{}
+	err := c.device.driver.gatewayConn.SendAsyncCommand(request, response, 20*time.Second)
+	if err != nil {
+		log.Errorf("Error enabling battery reporting: %s", err)
+	} else if response.Status.String() != "STATUS_SUCCESS" {
+		log.Errorf("Failed to enable battery reporting. status: %s", response.Status.String())
+	}
+}
+
+// handleReports publishes the battery attributes the device reports, between polls.
+func (c *BatteryChannel) handleReports() {
+
+	for frame := range c.bindCluster(ClusterIDPowerConfiguration) {
+		if frame.GetFrameType() != gateway.GwFrameTypeT_FRAME_ALL_PROFILE || frame.GetCommandId() != zclCommandReportAttributes {
+			continue
+		}
+
+		attributes, err := parseAttributeReport(frame)
+		if err != nil {
+			log.Warningf("Failed to parse battery report from device %X: %s", *c.device.deviceInfo.IeeeAddress, err)
+			continue
+		}
+
+		if err := c.updateAttributes(attributes); err != nil {
+			log.Debugf("Ignoring battery report from device %X: %s", *c.device.deviceInfo.IeeeAddress, err)
+		}
+	}
+}
+
+// config returns the battery config of the device, falling back to that of its model
+func (c *BatteryChannel) config() batteryConfig {
+	cfg := c.device.driver.modelConfig(c.device.ModelIdentifier).Battery
+
+	if deviceCfg, _ := c.device.config(); deviceCfg.Battery != nil {
+		if deviceCfg.Battery.Type != "" {
+			cfg.Type = deviceCfg.Battery.Type
+		}
+		if deviceCfg.Battery.Cells != 0 {
+			cfg.Cells = deviceCfg.Battery.Cells
+		}
+		if deviceCfg.Battery.LowBattery != nil {
+			cfg.LowBattery = deviceCfg.Battery.LowBattery
+		}
+	}
+
+	return cfg
+}
+
+func (c *BatteryChannel) fetchState() error {
+
+	attributes, err := c.readAttributes(ClusterIDPowerConfiguration,
+		PowerConfigAttributeBatteryVoltage, PowerConfigAttributeBatteryPercentageRemaining,
+		PowerConfigAttributeBatterySize, PowerConfigAttributeBatteryQuantity)
+	if err != nil {
+		return err
+	}
+
+	return c.updateAttributes(attributes)
+}
+
+// updateAttributes works out the battery level from the attributes we have been sent, along with the ones we
+// already had, and publishes it.
+func (c *BatteryChannel) updateAttributes(updated map[uint32]*gateway.GwAttributeRecordT) error {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.attributes == nil {
+		c.attributes = make(map[uint32]*gateway.GwAttributeRecordT)
+	}
+	for attributeID, attribute := range updated {
+		c.attributes[attributeID] = attribute
+	}
+	attributes := c.attributes
+
+	cfg := c.config()
+	state := &BatteryState{}
+
+	if attribute, ok := attributes[PowerConfigAttributeBatteryVoltage]; ok && attributeUint(attribute) != 0xFF {
+		voltage := float64(attributeUint(attribute)) / 10
+		state.Voltage = &voltage
+	}
+
+	if attribute, ok := attributes[PowerConfigAttributeBatteryPercentageRemaining]; ok && attributeUint(attribute) != 0xFF {
+		percentage := math.Min(float64(attributeUint(attribute))/2, 100)
+		state.Percentage = &percentage
+	}
+
+	if state.Percentage == nil && state.Voltage != nil {
+		batteryType := strings.ToLower(cfg.Type)
+		if attribute, ok := attributes[PowerConfigAttributeBatterySize]; ok && batteryType == "" {
+			batteryType = batterySizes[attributeUint(attribute)]
+		}
+
+		cells := cfg.Cells
+		if attribute, ok := attributes[PowerConfigAttributeBatteryQuantity]; ok && cells == 0 {
+			cells = int(attributeUint(attribute))
+		}
+		if cells == 0 {
+			cells = 1
+		}
+
+		if curve, ok := batteryCurves[batteryType]; ok {
+			percentage := voltageToPercentage(curve, *state.Voltage/float64(cells))
+			state.Percentage = &percentage
+		}
+	}
+
+	if state.Percentage == nil && state.Voltage == nil {
+		return fmt.Errorf("Device doesn't report its battery voltage or percentage")
+	}
+
+	c.updateState(state, cfg)
+
+	return nil
+}
+
+func (c *BatteryChannel) lowBattery(cfg batteryConfig) float64 {
+	if cfg.LowBattery != nil {
+		return *cfg.LowBattery
+	}
+	return defaultLowBattery
+}
+
+func (c *BatteryChannel) updateState(state *BatteryState, cfg batteryConfig) {
+
+	if reflect.DeepEqual(c.lastState, state) {
+		return
+	}
+
+	if state.Percentage != nil {
+		low := *state.Percentage < c.lowBattery(cfg)
+		if low && !c.low {
+			log.Infof("Battery of device %X is low (%.0f%%)", *c.device.deviceInfo.IeeeAddress, *state.Percentage)
+			c.SendEvent("low-battery", state)
+		}
+		c.low = low
+	}
+
+	c.lastState = state
+	c.SendEvent("state", state)
+	c.cacheState(state)
+}
+
+// voltageToPercentage interpolates the percentage remaining of a cell from a discharge curve
+func voltageToPercentage(curve []batteryPoint, voltage float64) float64 {
+	if voltage >= curve[0].voltage {
+		return 100
+	}
+	for i := 1; i < len(curve); i++ {
+		high, low := curve[i-1], curve[i]
+		if voltage >= low.voltage {
+			return low.percentage + (voltage-low.voltage)/(high.voltage-low.voltage)*(high.percentage-low.percentage)
+		}
+	}
+	return 0
+}
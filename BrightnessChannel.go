@@ -12,7 +12,61 @@ import (
 type BrightnessChannel struct {
 	Channel
 	lastState *float64
+	confirmed *float64 // the last brightness read from the device
 	channel   *channels.BrightnessChannel
+	setter    *coalescer
+
+	// the last brightness we were asked to set, for restoring after a power cut
+	lastCommanded *float64
+}
+
+func init() {
+	registerClusterHandler(&clusterHandler{
+		name:      "brightness",
+		clusterID: ClusterIDLevel,
+		direction: clusterInput,
+		newChannel: func(channel Channel) clusterChannel {
+			return &BrightnessChannel{Channel: channel}
+		},
+	})
+}
+
+// LevelMove starts the brightness moving up or down until it reaches the limit or is stopped.
+type LevelMove struct {
+	Direction string  `json:"direction"`           // "up" or "down"
+	Rate      float64 `json:"rate,omitempty"`      // brightness per second (0-1). Uses the device's default if not set.
+	WithOnOff bool    `json:"withOnOff,omitempty"` // turn the light on when moving up, and off when it reaches the bottom
+}
+
+// LevelStep moves the brightness up or down by a fixed amount.
+type LevelStep struct {
+	Direction  string  `json:"direction"`            // "up" or "down"
+	Step       float64 `json:"step"`                 // amount of brightness (0-1)
+	Transition *int    `json:"transition,omitempty"` // milliseconds
+	WithOnOff  bool    `json:"withOnOff,omitempty"`
+}
+
+// LevelStop stops a move or step that is in progress.
+type LevelStop struct {
+	WithOnOff bool `json:"withOnOff,omitempty"`
+}
+
+// levelControlChannel adds the continuous dimming commands to the exported brightness channel
+type levelControlChannel struct {
+	*channels.BrightnessChannel
+	brightness *BrightnessChannel
+}
+
+func (c *levelControlChannel) Move(params *LevelMove) error {
+	return c.brightness.move(params)
+}
+
+func (c *levelControlChannel) Step(params *LevelStep) error {
+	return c.brightness.step(params)
+}
+
+func (c *levelControlChannel) Stop(params *LevelStop) error {
+	return c.brightness.stop(params)
 }
 
 // -------- Brightness Protocol --------
@@ -50,14 +104,28 @@ func (c *BrightnessChannel) init() error {
 
 	//mosquitto_pub -m '{"id":123, "params": [0.1],"jsonrpc": "2.0","method":"set","time":132123123}' -t '$device/26b4f71484/channel/11-8'
 
+	c.setter = newCoalescer("brightness", c.fetchState, c.restoreState)
+
 	c.channel = channels.NewBrightnessChannel(c)
-	err := c.device.driver.Conn.ExportChannel(c.device, c.channel, c.ID)
+	err := c.device.driver.Conn.ExportChannel(c.device, &levelControlChannel{c.channel, c}, c.ID)
 	if err != nil {
 		log.Fatalf("Failed to announce brightness channel: %s", err)
 	}
 
+	var state float64
+	if c.cachedState(&state) {
+		sendCachedState(c.channel.SendEvent, state)
+	}
+
 	go func() {
+		c.device.driver.waitUntilReady()
+		go c.configurePowerOn()
+
 		for {
+			if c.setter.busy() {
+				time.Sleep(10 * time.Second)
+				continue
+			}
 			log.Debugf("Polling for brightness")
 			err := c.fetchState()
 			if err != nil {
@@ -71,15 +139,26 @@ func (c *BrightnessChannel) init() error {
 
 }
 
+func (c *BrightnessChannel) addToBatch(batch *BatchChannel) {
+	batch.brightness = c
+}
+
 func (c *BrightnessChannel) SetBrightness(state float64) error {
-	level := uint32(state * float64(math.MaxUint8))
-	transition := uint32(10) // 1/100th seconds?
+	return c.setter.submit(func() {
+		c.lastCommanded = &state
+		c.updateState(state)
+	}, func() error {
+		return c.setLevel(state, defaultTransitionTime)
+	})
+}
+
+func (c *BrightnessChannel) setLevel(state float64, transition uint32) error {
+	c.device.driver.waitUntilReady()
+
+	level := toLevel(state)
 
 	request := &gateway.DevSetLevelReq{
-		DstAddress: &gateway.GwAddressStructT{
-			AddressType: gateway.GwAddressTypeT_UNICAST.Enum(),
-			IeeeAddr:    c.device.deviceInfo.IeeeAddress,
-		},
+		DstAddress:     c.dstAddress(),
 		LevelValue:     &level,
 		TransitionTime: &transition,
 	}
@@ -93,16 +172,144 @@ func (c *BrightnessChannel) SetBrightness(state float64) error {
 		return fmt.Errorf("Failed to set brightness state. status: %s", response.Status.String())
 	}
 
-	c.lastState = nil
-	return c.fetchState()
+	return nil
+}
+
+// moveToLevel fades to the given brightness. If withOnOff is set, the light is also switched on
+// (or off at zero) as part of the same transition.
+func (c *BrightnessChannel) moveToLevel(state float64, transition uint32, withOnOff bool) error {
+	payload := append([]byte{byte(toLevel(state))}, uint16Bytes(transition)...)
+
+	command := LevelCommandMoveToLevel
+	if withOnOff {
+		command = LevelCommandMoveToLevelWithOnOff
+	}
+
+	err := c.sendCommand(ClusterIDLevel, command, payload)
+	if err != nil {
+		return fmt.Errorf("Failed to move to brightness level: %s", err)
+	}
+
+	return nil
+}
+
+// move, step and stop are sent straight away, in order, as coalescing them would drop steps or let a move
+// replace a stop. Any absolute set that is still waiting to be sent is out of date, so it is dropped.
+func (c *BrightnessChannel) move(params *LevelMove) error {
+	mode, err := levelDirection(params.Direction)
+	if err != nil {
+		return err
+	}
+
+	rate := uint32(0xFF) // use the device's default rate
+	if params.Rate > 0 {
+		rate = toLevel(params.Rate)
+		if rate == 0 {
+			rate = 1
+		} else if rate > 0xFE {
+			rate = 0xFE
+		}
+	}
+
+	command := LevelCommandMove
+	if params.WithOnOff {
+		command = LevelCommandMoveWithOnOff
+	}
+
+	c.setter.cancel()
+	if err := c.sendCommand(ClusterIDLevel, command, []byte{mode, byte(rate)}); err != nil {
+		return err
+	}
+
+	// A move runs until it is stopped or reaches the end of the range
+	duration := defaultMoveDuration
+	if rate != 0xFF {
+		duration = time.Duration(float64(0xFE) / float64(rate) * float64(time.Second))
+	}
+	c.refreshAfter(duration)
+	return nil
+}
+
+func (c *BrightnessChannel) step(params *LevelStep) error {
+	mode, err := levelDirection(params.Direction)
+	if err != nil {
+		return err
+	}
+
+	if params.Step <= 0 || params.Step > 1 {
+		return fmt.Errorf("Step must be between 0 and 1, got %f", params.Step)
+	}
+
+	command := LevelCommandStep
+	if params.WithOnOff {
+		command = LevelCommandStepWithOnOff
+	}
+
+	transition := transitionTime(params.Transition)
+	payload := append([]byte{mode, byte(toLevel(params.Step))}, uint16Bytes(transition)...)
+
+	c.setter.cancel()
+	if err := c.sendCommand(ClusterIDLevel, command, payload); err != nil {
+		return err
+	}
+
+	c.refreshAfter(time.Duration(transition) * 100 * time.Millisecond)
+	return nil
+}
+
+func (c *BrightnessChannel) stop(params *LevelStop) error {
+	command := LevelCommandStop
+	if params != nil && params.WithOnOff {
+		command = LevelCommandStopWithOnOff
+	}
+
+	c.setter.cancel()
+	if err := c.sendCommand(ClusterIDLevel, command, []byte{}); err != nil {
+		return err
+	}
+
+	c.refreshAfter(0)
+	return nil
+}
+
+// How long we wait to read the level back after a move at the device's default rate
+const defaultMoveDuration = 5 * time.Second
+
+// refreshAfter reads the level back once a move, step or stop has had time to finish, as nothing else tells
+// us what level it ended at.
+func (c *BrightnessChannel) refreshAfter(duration time.Duration) {
+	time.AfterFunc(duration+500*time.Millisecond, func() {
+		if err := c.fetchState(); err != nil {
+			log.Warningf("Failed to read brightness after changing it: %s", err)
+		}
+	})
+}
+
+// hasState returns true if the last known brightness is the same level as state.
+func (c *BrightnessChannel) hasState(state float64) bool {
+	return c.lastState != nil && toLevel(*c.lastState) == toLevel(state)
+}
+
+func (c *BrightnessChannel) updateState(state float64) {
+	if c.lastState == nil || *c.lastState != state {
+		c.lastState = &state
+		c.channel.SendState(state)
+		c.cacheState(state)
+	}
+}
+
+// restoreState publishes the last brightness read from the device again, after a set has failed
+func (c *BrightnessChannel) restoreState() {
+	if c.confirmed != nil {
+		c.updateState(*c.confirmed)
+	}
 }
 
 func (c *BrightnessChannel) fetchState() error {
+	version := c.setter.current()
+
 	request := &gateway.DevGetLevelReq{
-		DstAddress: &gateway.GwAddressStructT{
-			AddressType: gateway.GwAddressTypeT_UNICAST.Enum(),
-			IeeeAddr:    c.device.deviceInfo.IeeeAddress,
-		},
+		DstAddress: c.dstAddress(),
 	}
 
 	response := &gateway.DevGetLevelRspInd{}
@@ -115,11 +322,26 @@ func (c *BrightnessChannel) fetchState() error {
 	}
 
 	state := float64(*response.LevelValue) / float64(math.MaxUint8)
+	c.setter.publishRead(version, func() {
+		c.confirmed = &state
+		c.updateState(state)
+	})
 
-	if c.lastState == nil || *c.lastState != state {
-		c.lastState = &state
-		c.channel.SendState(state)
+	return nil
+}
+
+func levelDirection(direction string) (byte, error) {
+	switch direction {
+	case "up":
+		return 0x00, nil
+	case "down":
+		return 0x01, nil
 	}
+	return 0, fmt.Errorf("Unknown direction '%s'. Must be 'up' or 'down'", direction)
+}
 
-	return nil
+// toLevel converts a brightness from 0 to 1 to a ZCL level. 0xFF isn't a valid level, so 1 is 0xFE.
+func toLevel(state float64) uint32 {
+	state = math.Max(0, math.Min(state, 1))
+	return uint32(math.Min(math.Floor(state*float64(math.MaxUint8)+0.5), 0xFE))
 }
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strconv"
+	"time"
+
+	"github.com/ninjasphere/go-zigbee/nwkmgr"
+)
+
+// How long after a channel's state changes before the state cache is saved. Sensors can change often, so we
+// don't want to write it every time.
+const stateSaveDelay = time.Minute
+
+// endpointConfig is the cached simple descriptor of an endpoint, so that we can export a device at startup
+// without waiting for nwkmgr to send us the device list.
+type endpointConfig struct {
+	EndpointId     uint32
+	ProfileId      uint32
+	DeviceId       uint32
+	DeviceVer      uint32
+	InputClusters  []uint32
+	OutputClusters []uint32
+}
+
+// deviceStatus is sent as the "device-status" event when a cached device is exported ("stale") and when
+// we first hear from it ("online").
+type deviceStatus struct {
+	IEEE   string `json:"ieee"`
+	Status string `json:"status"`
+}
+
+func toEndpointConfigs(deviceInfo *nwkmgr.NwkDeviceInfoT) []endpointConfig {
+	var endpoints []endpointConfig
+	for _, endpoint := range deviceInfo.SimpleDescList {
+		endpoints = append(endpoints, endpointConfig{
+			EndpointId:     endpoint.GetEndpointId(),
+			ProfileId:      endpoint.GetProfileId(),
+			DeviceId:       endpoint.GetDeviceId(),
+			DeviceVer:      endpoint.GetDeviceVer(),
+			InputClusters:  endpoint.InputClusters,
+			OutputClusters: endpoint.OutputClusters,
+		})
+	}
+	return endpoints
+}
+
+// cachedDeviceInfo rebuilds the device info that nwkmgr gave us when the device was last seen.
+func (cfg *deviceConfig) cachedDeviceInfo(ieee uint64) *nwkmgr.NwkDeviceInfoT {
+	networkAddress := cfg.NetworkAddress
+
+	deviceInfo := &nwkmgr.NwkDeviceInfoT{
+		IeeeAddress:    &ieee,
+		NetworkAddress: &networkAddress,
+	}
+
+	for _, endpoint := range cfg.Endpoints {
+		endpoint := endpoint
+		deviceInfo.SimpleDescList = append(deviceInfo.SimpleDescList, &nwkmgr.NwkSimpleDescriptorT{
+			EndpointId:     &endpoint.EndpointId,
+			ProfileId:      &endpoint.ProfileId,
+			DeviceId:       &endpoint.DeviceId,
+			DeviceVer:      &endpoint.DeviceVer,
+			InputClusters:  endpoint.InputClusters,
+			OutputClusters: endpoint.OutputClusters,
+		})
+	}
+
+	return deviceInfo
+}
+
+// exportCachedDevices exports every device we have fully interviewed before, using what we cached about it,
+// so that they are available straight away. Their last known state is published, and they are marked as
+// stale until they show up in the device list from nwkmgr.
+func (d *Driver) exportCachedDevices() {
+
+	var cached []*nwkmgr.NwkDeviceInfoT
+
+	d.lock.Lock()
+	for id, cfg := range d.driverConfig.Devices {
+		if cfg.Interview != interviewComplete || len(cfg.Endpoints) == 0 {
+			continue
+		}
+
+		ieee, err := strconv.ParseUint(id, 16, 64)
+		if err != nil {
+			log.Warningf("Invalid IEEE address '%s' in device config: %s", id, err)
+			continue
+		}
+
+		cached = append(cached, cfg.cachedDeviceInfo(ieee))
+	}
+	d.lock.Unlock()
+
+	for _, deviceInfo := range cached {
+		log.Infof("Exporting cached device IEEE:%X", *deviceInfo.IeeeAddress)
+
+		d.exportDevice(deviceInfo)
+
+		d.lock.Lock()
+		d.devices[*deviceInfo.IeeeAddress].stale = true
+		d.lock.Unlock()
+
+		d.sendDeviceStatus(*deviceInfo.IeeeAddress, "stale")
+	}
+}
+
+func (d *Driver) sendDeviceStatus(ieee uint64, status string) {
+	d.SendEvent("device-status", &deviceStatus{
+		IEEE:   fmt.Sprintf("%X", ieee),
+		Status: status,
+	})
+}
+
+// reconcile is called the first time a cached device shows up in the device list from nwkmgr. If it doesn't
+// look the way we cached it (e.g. it has been re-paired with new firmware) it is interviewed again.
+// Must be called while holding d.lock.
+func (d *Driver) reconcile(device *Device, deviceInfo *nwkmgr.NwkDeviceInfoT) {
+
+	device.stale = false
+	go d.sendDeviceStatus(*deviceInfo.IeeeAddress, "online")
+
+	if reflect.DeepEqual(toEndpointConfigs(device.deviceInfo), toEndpointConfigs(deviceInfo)) {
+		return
+	}
+
+	log.Infof("Endpoints of device IEEE:%X have changed since it was cached. Interviewing it again", *deviceInfo.IeeeAddress)
+
+	id := fmt.Sprintf("%X", *deviceInfo.IeeeAddress)
+	cfg := d.driverConfig.Devices[id]
+	cfg.Interview = ""
+	d.driverConfig.Devices[id] = cfg
+
+	// The channels already exported stay as they are until the driver is restarted
+	iv := &interview{
+		driver:     d,
+		deviceInfo: deviceInfo,
+		device:     device,
+	}
+	d.interviews[*deviceInfo.IeeeAddress] = iv
+	iv.start()
+}
+
+// cacheDeviceInfo saves the parts of the device info we need to export the device at startup, returning
+// true if they have changed and the config needs saving.
+// Must be called while holding d.lock.
+func (d *Driver) cacheDeviceInfo(deviceInfo *nwkmgr.NwkDeviceInfoT) bool {
+	id := fmt.Sprintf("%X", *deviceInfo.IeeeAddress)
+	cfg := d.driverConfig.Devices[id]
+
+	endpoints := toEndpointConfigs(deviceInfo)
+
+	if cfg.NetworkAddress == deviceInfo.GetNetworkAddress() && reflect.DeepEqual(cfg.Endpoints, endpoints) {
+		return false
+	}
+
+	cfg.NetworkAddress = deviceInfo.GetNetworkAddress()
+	cfg.Endpoints = endpoints
+	d.driverConfig.Devices[id] = cfg
+
+	return true
+}
+
+// cacheState saves the last known state of a channel, to be published when the device is exported from
+// the cache at startup.
+func (d *Driver) cacheState(ieee uint64, channelID string, state interface{}) {
+
+	value, err := json.Marshal(state)
+	if err != nil {
+		log.Warningf("Failed to cache state of channel %s: %s", channelID, err)
+		return
+	}
+
+	id := fmt.Sprintf("%X", ieee)
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	states := d.stateCache[id]
+	if bytes.Equal(states[channelID], value) {
+		return
+	}
+	if states == nil {
+		states = make(map[string]json.RawMessage)
+		d.stateCache[id] = states
+	}
+	states[channelID] = value
+
+	if !d.stateSavePending {
+		d.stateSavePending = true
+		time.AfterFunc(stateSaveDelay, d.saveStateCache)
+	}
+}
+
+// cachedState reads the last known state of a channel into state, returning false if there isn't one.
+func (d *Driver) cachedState(ieee uint64, channelID string, state interface{}) bool {
+	d.lock.Lock()
+	value, ok := d.stateCache[fmt.Sprintf("%X", ieee)][channelID]
+	d.lock.Unlock()
+
+	if !ok {
+		return false
+	}
+
+	if err := json.Unmarshal(value, state); err != nil {
+		log.Warningf("Failed to read cached state of channel %s: %s", channelID, err)
+		return false
+	}
+
+	return true
+}
+
+// loadStateCache reads the state cache saved by saveStateCache.
+func (d *Driver) loadStateCache() {
+
+	data, err := ioutil.ReadFile(d.config.StateFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Warningf("Failed to read state cache %s: %s", d.config.StateFile, err)
+		}
+		return
+	}
+
+	var states map[string]map[string]json.RawMessage
+	if err := json.Unmarshal(data, &states); err != nil {
+		log.Warningf("Failed to parse state cache %s: %s", d.config.StateFile, err)
+		return
+	}
+
+	d.lock.Lock()
+	for id, state := range states {
+		d.stateCache[id] = state
+	}
+	d.lock.Unlock()
+}
+
+// saveStateCache writes the state cache to its file, via a temporary file so that a crash can't leave it
+// half written.
+func (d *Driver) saveStateCache() {
+
+	d.lock.Lock()
+	d.stateSavePending = false
+	data, err := json.Marshal(d.stateCache)
+	d.lock.Unlock()
+
+	if err != nil {
+		log.Warningf("Failed to save state cache: %s", err)
+		return
+	}
+
+	tmp := d.config.StateFile + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		log.Warningf("Failed to save state cache %s: %s", d.config.StateFile, err)
+		return
+	}
+	if err := os.Rename(tmp, d.config.StateFile); err != nil {
+		log.Warningf("Failed to save state cache %s: %s", d.config.StateFile, err)
+	}
+}
+
+// waitUntilReady blocks until we have connected to the Z-Stack servers. Devices exported from the cache
+// can be asked to do things before then.
+func (d *Driver) waitUntilReady() {
+	<-d.ready
+}
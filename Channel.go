@@ -1,9 +1,69 @@
 package main
 
-import "github.com/ninjasphere/go-zigbee/nwkmgr"
+import (
+	"github.com/ninjasphere/go-zigbee/gateway"
+	"github.com/ninjasphere/go-zigbee/nwkmgr"
+)
 
 type Channel struct {
 	ID       string
 	device   *Device
 	endpoint *nwkmgr.NwkSimpleDescriptorT
 }
+
+// dstAddress is the address used for all commands and reads sent by the channel, so that on
+// devices with more than one endpoint (e.g. 2-gang switches) we control the right one.
+func (c *Channel) dstAddress() *gateway.GwAddressStructT {
+	return &gateway.GwAddressStructT{
+		AddressType: gateway.GwAddressTypeT_UNICAST.Enum(),
+		IeeeAddr:    c.device.deviceInfo.IeeeAddress,
+		EndpointId:  c.endpoint.EndpointId,
+	}
+}
+
+// cacheState saves the channel's state so it can be published straight away the next time the driver starts.
+func (c *Channel) cacheState(state interface{}) {
+	c.device.driver.cacheState(*c.device.deviceInfo.IeeeAddress, c.ID, state)
+}
+
+// cachedState reads the channel's last known state into state, returning false if there isn't one.
+func (c *Channel) cachedState(state interface{}) bool {
+	return c.device.driver.cachedState(*c.device.deviceInfo.IeeeAddress, c.ID, state)
+}
+
+// measurementChannel exports a single measured value (e.g. energy or voltage) for which go-ninja has no channel.
+type measurementChannel struct {
+	protocol  string
+	SendEvent func(event string, payload ...interface{}) error
+}
+
+func (c *measurementChannel) SetEventHandler(handler func(event string, payload ...interface{}) error) {
+	c.SendEvent = handler
+}
+
+func (c *measurementChannel) GetProtocol() string {
+	return c.protocol
+}
+
+func (c *measurementChannel) SendState(state float64) error {
+	if c.SendEvent == nil {
+		return nil
+	}
+	return c.SendEvent("state", state)
+}
+
+// cachedStateEvent is the payload of the "cached-state" event
+type cachedStateEvent struct {
+	State interface{} `json:"state"`
+	Stale bool        `json:"stale"`
+}
+
+// sendCachedState publishes the last known state of a channel, read from the cache when the device is exported.
+// It is sent as the "cached-state" event, marked as stale, rather than as "state", so that consumers can tell it
+// apart from state read from the device.
+func sendCachedState(sendEvent func(event string, payload ...interface{}) error, state interface{}) {
+	if sendEvent == nil {
+		return
+	}
+	sendEvent("cached-state", &cachedStateEvent{State: state, Stale: true})
+}
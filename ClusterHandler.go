@@ -0,0 +1,191 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/ninjasphere/go-zigbee/nwkmgr"
+)
+
+type clusterDirection int
+
+const (
+	clusterInput  clusterDirection = iota // the device is the server of the cluster (e.g. a light's on/off)
+	clusterOutput                         // the device is the client of the cluster (e.g. a switch's on/off)
+)
+
+// clusterChannel is the channel a cluster handler creates for an endpoint.
+type clusterChannel interface {
+	init() error
+}
+
+// batchable channels can be controlled as part of their endpoint's batch channel.
+type batchable interface {
+	addToBatch(batch *BatchChannel)
+}
+
+// clusterHandler creates a channel for each endpoint that has its cluster. Each handler registers
+// itself from the init() of the file that implements it, and is kept in clusterHandlerOrder.
+type clusterHandler struct {
+	name      string // used to enable or disable the handler in the driver config
+	clusterID uint32
+	direction clusterDirection
+	idSuffix  string // appended to the channel ID, which is "{endpoint}-{cluster}"
+
+	// The handler is only used if the driver config enables it
+	optional bool
+
+	// If set, the handler is only used on endpoints with one of these device IDs
+	deviceIDs []uint32
+
+	// If set, the handler is only used if this returns true (e.g. to work around a quirk of a model)
+	match func(device *Device, endpoint *nwkmgr.NwkSimpleDescriptorT) bool
+
+	// If set, called during the device's interview, before any channels are created. Anything it
+	// finds out should be saved in the device config.
+	interview func(device *Device, endpoint *nwkmgr.NwkSimpleDescriptorT) error
+
+	newChannel func(channel Channel) clusterChannel
+
+	// If set instead of newChannel, the handler is used for every input cluster that no other
+	// handler created a channel for, except those in skipClusters.
+	newFallbackChannel func(channel Channel, clusterID uint32) clusterChannel
+	skipClusters       []uint32
+}
+
+var clusterHandlers []*clusterHandler
+
+// clusterHandlerOrder is the order the channels of an endpoint are exported in, by handler name. It doesn't
+// depend on the order the handlers are registered in (i.e. the file names). Handlers not listed go last.
+var clusterHandlerOrder = []string{
+	"on-off",
+	"on-off-switch",
+	"power",
+	"temperature",
+	"humidity",
+	"brightness",
+	"color",
+	"ias-zone",
+	"ias-wd",
+	"ias-ace",
+	"battery",
+	"electrical",
+	"illuminance",
+	"pressure",
+	"flow",
+	"zigbee-attributes",
+}
+
+func clusterHandlerPosition(name string) int {
+	for i, ordered := range clusterHandlerOrder {
+		if ordered == name {
+			return i
+		}
+	}
+	return len(clusterHandlerOrder)
+}
+
+func registerClusterHandler(handler *clusterHandler) {
+	position := clusterHandlerPosition(handler.name)
+
+	i := len(clusterHandlers)
+	for i > 0 && clusterHandlerPosition(clusterHandlers[i-1].name) > position {
+		i--
+	}
+
+	clusterHandlers = append(clusterHandlers, nil)
+	copy(clusterHandlers[i+1:], clusterHandlers[i:])
+	clusterHandlers[i] = handler
+}
+
+func (h *clusterHandler) matches(device *Device, endpoint *nwkmgr.NwkSimpleDescriptorT) bool {
+
+	if h.newFallbackChannel != nil {
+		return false
+	}
+
+	clusters := endpoint.InputClusters
+	if h.direction == clusterOutput {
+		clusters = endpoint.OutputClusters
+	}
+
+	if !containsUInt32(clusters, h.clusterID) {
+		return false
+	}
+
+	if h.deviceIDs != nil && !containsUInt32(h.deviceIDs, *endpoint.DeviceId) {
+		return false
+	}
+
+	return h.match == nil || h.match(device, endpoint)
+}
+
+func (h *clusterHandler) channelID(endpoint *nwkmgr.NwkSimpleDescriptorT, clusterID uint32) string {
+	return fmt.Sprintf("%d-%d%s", *endpoint.EndpointId, clusterID, h.idSuffix)
+}
+
+// handlerEnabled returns whether a cluster handler should be used, which can be overridden by
+// the Handlers map of the driver config.
+func (d *Driver) handlerEnabled(handler *clusterHandler) bool {
+	if enabled, ok := d.driverConfig.Handlers[handler.name]; ok {
+		return enabled
+	}
+	return !handler.optional
+}
+
+// exportClusterChannels creates and initialises the channels for each of the clusters on an endpoint
+// that we have a handler for.
+func (d *Driver) exportClusterChannels(device *Device, endpoint *nwkmgr.NwkSimpleDescriptorT, batch *BatchChannel) {
+
+	handled := make(map[uint32]bool)
+
+	for _, handler := range clusterHandlers {
+		if !d.handlerEnabled(handler) || !handler.matches(device, endpoint) {
+			continue
+		}
+
+		if handler.direction == clusterInput {
+			handled[handler.clusterID] = true
+		}
+
+		log.Debugf("Endpoint %d has cluster 0x%X. Exporting %s channel", *endpoint.EndpointId, handler.clusterID, handler.name)
+
+		channel := handler.newChannel(Channel{
+			ID:       handler.channelID(endpoint, handler.clusterID),
+			device:   device,
+			endpoint: endpoint,
+		})
+
+		err := channel.init()
+		if err != nil {
+			log.Debugf("Failed initialising %s channel: %s", handler.name, err)
+		}
+
+		if b, ok := channel.(batchable); ok {
+			b.addToBatch(batch)
+		}
+	}
+
+	for _, handler := range clusterHandlers {
+		if handler.newFallbackChannel == nil || !d.handlerEnabled(handler) {
+			continue
+		}
+
+		for _, clusterID := range endpoint.InputClusters {
+			if handled[clusterID] || containsUInt32(handler.skipClusters, clusterID) {
+				continue
+			}
+
+			log.Debugf("Endpoint %d has unsupported cluster 0x%X. Exporting %s channel", *endpoint.EndpointId, clusterID, handler.name)
+
+			channel := handler.newFallbackChannel(Channel{
+				ID:       handler.channelID(endpoint, clusterID),
+				device:   device,
+				endpoint: endpoint,
+			}, clusterID)
+
+			if err := channel.init(); err != nil {
+				log.Debugf("Failed initialising %s channel: %s", handler.name, err)
+			}
+		}
+	}
+}
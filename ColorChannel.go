@@ -12,7 +12,24 @@ import (
 
 type ColorChannel struct {
 	Channel
-	channel *channels.ColorChannel
+	lastState *channels.ColorState
+	confirmed *channels.ColorState // the last color read from the device
+	channel   *channels.ColorChannel
+	setter    *coalescer
+
+	// the last color we were asked to set, for restoring after a power cut
+	lastCommanded *channels.ColorState
+}
+
+func init() {
+	registerClusterHandler(&clusterHandler{
+		name:      "color",
+		clusterID: ClusterIDColor,
+		direction: clusterInput,
+		newChannel: func(channel Channel) clusterChannel {
+			return &ColorChannel{Channel: channel}
+		},
+	})
 }
 
 // -------- Color Protocol --------
@@ -50,14 +67,28 @@ func (c *ColorChannel) init() error {
 
 	//mosquitto_pub -m '{"id":123, "params": [0.1],"jsonrpc": "2.0","method":"set","time":132123123}' -t '$device/26b4f71484/channel/11-8'
 
+	c.setter = newCoalescer("color", c.fetchState, c.restoreState)
+
 	c.channel = channels.NewColorChannel(c)
 	err := c.device.driver.Conn.ExportChannel(c.device, c.channel, c.ID)
 	if err != nil {
 		log.Fatalf("Failed to announce color channel: %s", err)
 	}
 
+	state := &channels.ColorState{}
+	if c.cachedState(state) {
+		sendCachedState(c.channel.SendEvent, state)
+	}
+
 	go func() {
+		c.device.driver.waitUntilReady()
+		go c.configurePowerOn()
+
 		for {
+			if c.setter.busy() {
+				time.Sleep(10 * time.Second)
+				continue
+			}
 			log.Debugf("Polling for color")
 			err := c.fetchState()
 			if err != nil {
@@ -71,22 +102,32 @@ func (c *ColorChannel) init() error {
 
 }
 
+func (c *ColorChannel) addToBatch(batch *BatchChannel) {
+	batch.color = c
+}
+
 func (c *ColorChannel) SetColor(state *channels.ColorState) error {
 
 	if state.Mode != "hue" {
 		return fmt.Errorf("TODO: Only color mode 'hue' is supported atm.")
 	}
 
+	return c.setter.submit(func() {
+		c.updateCommanded(state)
+	}, func() error {
+		return c.setColor(state)
+	})
+}
+
+func (c *ColorChannel) setColor(state *channels.ColorState) error {
+	c.device.driver.waitUntilReady()
+
 	spew.Dump("setting color", state)
 
-	hue := uint32(*state.Hue * float64(math.MaxUint8-1))
-	saturation := uint32(*state.Saturation * float64(math.MaxUint8-1))
+	hue, saturation := toHueAndSaturation(state)
 
 	request := &gateway.DevSetColorReq{
-		DstAddress: &gateway.GwAddressStructT{
-			AddressType: gateway.GwAddressTypeT_UNICAST.Enum(),
-			IeeeAddr:    c.device.deviceInfo.IeeeAddress,
-		},
+		DstAddress:      c.dstAddress(),
 		HueValue:        &hue,
 		SaturationValue: &saturation,
 	}
@@ -102,15 +143,70 @@ func (c *ColorChannel) SetColor(state *channels.ColorState) error {
 		return fmt.Errorf("Failed to set color state. status: %s", response.Status.String())
 	}
 
-	return c.fetchState()
+	return nil
+}
+
+// moveToHueAndSaturation fades to the given color over the transition time.
+func (c *ColorChannel) moveToHueAndSaturation(state *channels.ColorState, transition uint32) error {
+
+	if state.Mode != "hue" {
+		return fmt.Errorf("TODO: Only color mode 'hue' is supported atm.")
+	}
+
+	hue, saturation := toHueAndSaturation(state)
+	payload := append([]byte{byte(hue), byte(saturation)}, uint16Bytes(transition)...)
+
+	err := c.sendCommand(ClusterIDColor, ColorCommandMoveToHueAndSaturation, payload)
+	if err != nil {
+		return fmt.Errorf("Failed to move to color: %s", err)
+	}
+
+	return nil
+}
+
+// hasState returns true if the last known color is the same hue and saturation as state.
+func (c *ColorChannel) hasState(state *channels.ColorState) bool {
+	if c.lastState == nil || state.Mode != "hue" {
+		return false
+	}
+	if state.Hue == nil || state.Saturation == nil || c.lastState.Hue == nil || c.lastState.Saturation == nil {
+		return false
+	}
+
+	hue, saturation := toHueAndSaturation(state)
+	lastHue, lastSaturation := toHueAndSaturation(c.lastState)
+
+	return hue == lastHue && saturation == lastSaturation
+}
+
+func (c *ColorChannel) updateState(state *channels.ColorState) {
+	c.lastState = state
+	c.channel.SendState(state)
+	c.cacheState(state)
+}
+
+// updateCommanded publishes a hue and saturation we've been asked to set, before it has been sent
+func (c *ColorChannel) updateCommanded(state *channels.ColorState) {
+	c.lastCommanded = state
+	c.updateState(&channels.ColorState{
+		Mode:       "Hue",
+		Hue:        state.Hue,
+		Saturation: state.Saturation,
+	})
+}
+
+// restoreState publishes the last color read from the device again, after a set has failed
+func (c *ColorChannel) restoreState() {
+	if c.confirmed != nil {
+		c.updateState(c.confirmed)
+	}
 }
 
 func (c *ColorChannel) fetchState() error {
+	version := c.setter.current()
+
 	request := &gateway.DevGetColorReq{
-		DstAddress: &gateway.GwAddressStructT{
-			AddressType: gateway.GwAddressTypeT_UNICAST.Enum(),
-			IeeeAddr:    c.device.deviceInfo.IeeeAddress,
-		},
+		DstAddress: c.dstAddress(),
 	}
 
 	response := &gateway.DevGetColorRspInd{}
@@ -130,8 +226,16 @@ func (c *ColorChannel) fetchState() error {
 		Saturation: &saturation,
 		Hue:        &hue,
 	}
-
-	c.channel.SendState(state)
+	c.setter.publishRead(version, func() {
+		c.confirmed = state
+		c.updateState(state)
+	})
 
 	return nil
 }
+
+func toHueAndSaturation(state *channels.ColorState) (uint32, uint32) {
+	hue := uint32(math.Floor(*state.Hue*float64(math.MaxUint8-1) + 0.5))
+	saturation := uint32(math.Floor(*state.Saturation*float64(math.MaxUint8-1) + 0.5))
+	return hue, saturation
+}
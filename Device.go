@@ -2,7 +2,11 @@ package main
 
 import (
 	"fmt"
+	"reflect"
 	"regexp"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/ninjasphere/go-ninja/api"
@@ -15,12 +19,24 @@ type Device struct {
 	info      *model.Device
 	sendEvent func(event string, payload interface{}) error
 
-	ManufacturerName string
-	ModelIdentifier  string
+	basicInfo
 
 	driver     *Driver
 	deviceInfo *nwkmgr.NwkDeviceInfoT
 	channels   []Channel
+
+	rejoinLock     sync.Mutex
+	rejoinHandlers []func()
+
+	// the devices each endpoint is exported as, if this device has been split up
+	children []*Device
+
+	// exported from the cache, and not yet seen in the device list from nwkmgr
+	stale bool
+
+	// the attributes of each cluster, discovered once for all of the device's attributes channels
+	attributesLock sync.Mutex
+	attributes     map[uint32][]uint32
 }
 
 var cleanStart, err = regexp.Compile(`(^[^\w -]+)`)
@@ -29,13 +45,140 @@ func cleanString(str []byte) string {
 	return string(cleanStart.ReplaceAll(str, []byte("")))
 }
 
+// Attributes of the Basic cluster
+const (
+	BasicAttributeZCLVersion         uint32 = 0x0000
+	BasicAttributeApplicationVersion uint32 = 0x0001
+	BasicAttributeStackVersion       uint32 = 0x0002
+	BasicAttributeHWVersion          uint32 = 0x0003
+	BasicAttributeManufacturerName   uint32 = 0x0004
+	BasicAttributeModelIdentifier    uint32 = 0x0005
+	BasicAttributeDateCode           uint32 = 0x0006
+	BasicAttributePowerSource        uint32 = 0x0007
+	BasicAttributeSWBuildID          uint32 = 0x4000
+)
+
+var powerSources = map[uint64]string{
+	0x00: "unknown",
+	0x01: "mains-single-phase",
+	0x02: "mains-three-phase",
+	0x03: "battery",
+	0x04: "dc",
+	0x05: "emergency-mains-constant",
+	0x06: "emergency-mains-transfer-switch",
+}
+
+// basicInfo is what we know about a device from its Basic cluster. Anything the device doesn't support is left empty.
+type basicInfo struct {
+	ManufacturerName   string
+	ModelIdentifier    string
+	ZCLVersion         *uint64
+	ApplicationVersion *uint64
+	StackVersion       *uint64
+	HWVersion          *uint64
+	DateCode           string
+	PowerSource        string
+	SWBuildID          string
+}
+
+// signatures returns the basic info as device signatures
+func (b *basicInfo) signatures() map[string]string {
+	signatures := map[string]string{}
+
+	values := map[string]string{
+		"zigbee:ManufacturerName": b.ManufacturerName,
+		"zigbee:ModelIdentifier":  b.ModelIdentifier,
+		"zigbee:DateCode":         b.DateCode,
+		"zigbee:PowerSource":      b.PowerSource,
+		"zigbee:SWBuildID":        b.SWBuildID,
+	}
+	for key, value := range values {
+		if value != "" {
+			signatures[key] = value
+		}
+	}
+
+	numbers := map[string]*uint64{
+		"zigbee:ZCLVersion":         b.ZCLVersion,
+		"zigbee:ApplicationVersion": b.ApplicationVersion,
+		"zigbee:StackVersion":       b.StackVersion,
+		"zigbee:HWVersion":          b.HWVersion,
+	}
+	for key, value := range numbers {
+		if value != nil {
+			signatures[key] = fmt.Sprintf("%d", *value)
+		}
+	}
+
+	return signatures
+}
+
+// compositionSignatures describes the node type of the device and the profile, device ID and clusters of each
+// of the given endpoints, so that apps can match on capabilities rather than on models. Each endpoint is
+// e.g. "zigbee:Endpoint1": "p=0104;d=0051;in=0000,0003,0006,0702;out=0019", with the clusters sorted.
+func compositionSignatures(cfg deviceConfig, endpoints []*nwkmgr.NwkSimpleDescriptorT) map[string]string {
+	signatures := map[string]string{}
+
+	if cfg.NodeType != "" {
+		signatures["zigbee:NodeType"] = cfg.NodeType
+	}
+	if cfg.Power != "" {
+		signatures["zigbee:Power"] = cfg.Power
+	}
+
+	var ids []string
+	for _, endpoint := range endpoints {
+		ids = append(ids, fmt.Sprintf("%d", endpoint.GetEndpointId()))
+
+		signatures[fmt.Sprintf("zigbee:Endpoint%d", endpoint.GetEndpointId())] = fmt.Sprintf("p=%04X;d=%04X;in=%s;out=%s",
+			endpoint.GetProfileId(), endpoint.GetDeviceId(), clusterList(endpoint.InputClusters), clusterList(endpoint.OutputClusters))
+	}
+	signatures["zigbee:Endpoints"] = strings.Join(ids, ",")
+
+	return signatures
+}
+
+func clusterList(clusters []uint32) string {
+	sorted := make([]int, len(clusters))
+	for i, cluster := range clusters {
+		sorted[i] = int(cluster)
+	}
+	sort.Ints(sorted)
+
+	list := make([]string, len(sorted))
+	for i, cluster := range sorted {
+		list[i] = fmt.Sprintf("%04X", cluster)
+	}
+	return strings.Join(list, ",")
+}
+
 func (d *Device) getBasicInfo() error {
 
 	log.Debugf("Getting basic information from %X", *d.deviceInfo.IeeeAddress)
 
+	// The strings can be long, so we ask for them in small groups to keep each response in a single frame.
+	// Only the names are required, the rest are optional so it doesn't matter if they fail.
+	err := d.readBasicAttributes(BasicAttributeManufacturerName, BasicAttributeModelIdentifier)
+	if err != nil {
+		return err
+	}
+
+	err = d.readBasicAttributes(BasicAttributeZCLVersion, BasicAttributeApplicationVersion, BasicAttributeStackVersion, BasicAttributeHWVersion, BasicAttributePowerSource)
+	if err != nil {
+		log.Debugf("Failed to get versions from %X: %s", *d.deviceInfo.IeeeAddress, err)
+	}
+
+	err = d.readBasicAttributes(BasicAttributeDateCode, BasicAttributeSWBuildID)
+	if err != nil {
+		log.Debugf("Failed to get date code and build from %X: %s", *d.deviceInfo.IeeeAddress, err)
+	}
+
+	return nil
+}
+
+func (d *Device) readBasicAttributes(attributes ...uint32) error {
+
 	cluster := ClusterIDBasic
-	ManufacturerNameAttribute := uint32(0x004)
-	ModelIdentifierAttribute := uint32(0x005)
 
 	request := &gateway.GwReadDeviceAttributeReq{
 		DstAddress: &gateway.GwAddressStructT{
@@ -43,7 +186,7 @@ func (d *Device) getBasicInfo() error {
 			IeeeAddr:    d.deviceInfo.IeeeAddress,
 		},
 		ClusterId:     &cluster,
-		AttributeList: []uint32{ManufacturerNameAttribute, ModelIdentifierAttribute},
+		AttributeList: attributes,
 	}
 
 	response := &gateway.GwReadDeviceAttributeRspInd{}
@@ -57,11 +200,30 @@ func (d *Device) getBasicInfo() error {
 
 	for _, attribute := range response.AttributeRecordList {
 
+		value := attributeUint(attribute)
+
 		switch *attribute.AttributeId {
-		case ManufacturerNameAttribute:
+		case BasicAttributeManufacturerName:
 			d.ManufacturerName = cleanString(attribute.AttributeValue)
-		case ModelIdentifierAttribute:
+		case BasicAttributeModelIdentifier:
 			d.ModelIdentifier = cleanString(attribute.AttributeValue)
+		case BasicAttributeZCLVersion:
+			d.ZCLVersion = &value
+		case BasicAttributeApplicationVersion:
+			d.ApplicationVersion = &value
+		case BasicAttributeStackVersion:
+			d.StackVersion = &value
+		case BasicAttributeHWVersion:
+			d.HWVersion = &value
+		case BasicAttributeDateCode:
+			d.DateCode = cleanString(attribute.AttributeValue)
+		case BasicAttributeSWBuildID:
+			d.SWBuildID = cleanString(attribute.AttributeValue)
+		case BasicAttributePowerSource:
+			d.PowerSource = powerSources[value&0x7F]
+			if value&0x80 != 0 {
+				d.PowerSource += "+battery-backup"
+			}
 		default:
 			log.Debugf("Unknown attribute returned when finding basic info %s", *attribute.AttributeId)
 		}
@@ -70,6 +232,182 @@ func (d *Device) getBasicInfo() error {
 	return nil
 }
 
+// How often we check whether a device's software has changed, in case we missed it announcing itself after
+// an OTA upgrade
+const buildCheckInterval = 6 * time.Hour
+
+// watchBuild refreshes the basic info whenever the device's software build or application version changes.
+func (d *Device) watchBuild() {
+	for {
+		time.Sleep(buildCheckInterval)
+
+		current := &Device{
+			driver:     d.driver,
+			deviceInfo: d.deviceInfo,
+			basicInfo:  d.basicInfo,
+		}
+
+		if err := current.readBasicAttributes(BasicAttributeApplicationVersion, BasicAttributeSWBuildID); err != nil {
+			log.Debugf("Failed to check software build of device %X: %s", *d.deviceInfo.IeeeAddress, err)
+			continue
+		}
+
+		if current.SWBuildID != d.SWBuildID || !reflect.DeepEqual(current.ApplicationVersion, d.ApplicationVersion) {
+			log.Infof("Software of device %X has changed", *d.deviceInfo.IeeeAddress)
+			d.refreshBasicInfo()
+		}
+	}
+}
+
+// refreshBasicInfo reads the basic info again (e.g. after the device announces itself on rejoining, which it
+// does after an OTA upgrade) and updates the device config and signatures if anything changed.
+func (d *Device) refreshBasicInfo() {
+
+	// Only attributes that are read successfully replace what we had, so that an optional read that
+	// fails (or an attribute that isn't returned this time) doesn't look like a change.
+	device := &Device{
+		driver:     d.driver,
+		deviceInfo: d.deviceInfo,
+		basicInfo:  d.basicInfo,
+	}
+
+	if err := device.getBasicInfo(); err != nil {
+		log.Warningf("Failed to refresh basic info of device %X: %s", *d.deviceInfo.IeeeAddress, err)
+		return
+	}
+
+	if reflect.DeepEqual(device.basicInfo, d.basicInfo) {
+		return
+	}
+
+	log.Infof("Basic info of device %X has changed", *d.deviceInfo.IeeeAddress)
+
+	d.driver.updateDeviceConfig(*d.deviceInfo.IeeeAddress, func(cfg *deviceConfig) {
+		cfg.basicInfo = device.basicInfo
+	})
+
+	d.republish()
+}
+
+// config returns the saved configuration of the device, if any.
+func (d *Device) config() (deviceConfig, bool) {
+	d.driver.lock.Lock()
+	defer d.driver.lock.Unlock()
+	cfg, ok := d.driver.driverConfig.Devices[fmt.Sprintf("%X", *d.deviceInfo.IeeeAddress)]
+	return cfg, ok
+}
+
+// updateInfo sets the name and signatures of the device from what we found when interviewing it.
+func (d *Device) updateInfo() {
+
+	cfg, _ := d.config()
+	d.basicInfo = cfg.basicInfo
+
+	signatures := *d.info.Signatures
+
+	for key, value := range d.basicInfo.signatures() {
+		signatures[key] = value
+	}
+
+	// Endpoints can go away after a firmware upgrade, so clear the old ones before writing them again
+	for key := range signatures {
+		if strings.HasPrefix(key, "zigbee:Endpoint") {
+			delete(signatures, key)
+		}
+	}
+
+	for key, value := range compositionSignatures(cfg, d.deviceInfo.SimpleDescList) {
+		signatures[key] = value
+	}
+
+	// As before, the device is the type of the last endpoint that we recognise. The clusters are only used
+	// to guess it if none of them are, so that e.g. a sensor's extra endpoint doesn't override its known type.
+	thingType := ""
+	for _, endpoint := range d.deviceInfo.SimpleDescList {
+		if t := d.knownThingType(endpoint); t != "" {
+			thingType = t
+		}
+	}
+	if thingType == "" {
+		for _, endpoint := range d.deviceInfo.SimpleDescList {
+			if t := clusterThingType(endpoint); t != "" {
+				thingType = t
+			}
+		}
+	}
+	if thingType != "" {
+		signatures["ninja:thingType"] = thingType
+	}
+
+	name := ""
+
+	if d.ModelIdentifier != "" {
+		name = d.ModelIdentifier
+	}
+
+	if d.ManufacturerName != "" {
+		if d.ModelIdentifier != "" {
+			name += " by "
+		}
+		name += d.ManufacturerName
+	}
+
+	if d.ManufacturerName == "MRVL" && d.ModelIdentifier == "MZ100" {
+		signatures["zigbee:ManufacturerName"] = d.ManufacturerName
+		signatures["ninja:manufacturer"] = "Belkin"
+		signatures["ninja:productName"] = "WeMo Smart LED Bulb"
+		name = "WeMo Smart Bulb"
+	}
+
+	if name != "" {
+		d.info.Name = &name
+	}
+}
+
+// republish updates the info of a device that has already been exported (e.g. after it has been reinterviewed)
+// and exports it again so that the change is seen. If the device has been split up, its endpoints are exported
+// again instead.
+func (d *Device) republish() {
+	d.updateInfo()
+
+	devices := []*Device{d}
+	if len(d.children) > 0 {
+		devices = d.children
+		for _, child := range d.children {
+			child.basicInfo = d.basicInfo
+			for key, value := range d.basicInfo.signatures() {
+				(*child.info.Signatures)[key] = value
+			}
+		}
+	}
+
+	for _, device := range devices {
+		if err := d.driver.Conn.ExportDevice(device); err != nil {
+			log.Warningf("Failed to republish device %s: %s", device.info.NaturalID, err)
+		}
+	}
+}
+
+// onRejoin registers a handler to be called when the device rejoins the network.
+func (d *Device) onRejoin(handler func()) {
+	d.rejoinLock.Lock()
+	d.rejoinHandlers = append(d.rejoinHandlers, handler)
+	d.rejoinLock.Unlock()
+}
+
+func (d *Device) rejoined() {
+	d.rejoinLock.Lock()
+	handlers := d.rejoinHandlers
+	d.rejoinLock.Unlock()
+
+	for _, handler := range handlers {
+		go handler()
+	}
+	for _, child := range d.children {
+		child.rejoined()
+	}
+}
+
 func (d *Device) GetDeviceInfo() *model.Device {
 	return d.info
 }
@@ -1,8 +1,11 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"os"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/davecgh/go-spew/spew"
@@ -15,14 +18,25 @@ import (
 )
 
 const (
-	ClusterIDBasic    uint32 = 0x00
-	ClusterIDOnOff    uint32 = 0x06
-	ClusterIDLevel    uint32 = 0x08 // We're always exporting as brightness for now
-	ClusterIDColor    uint32 = 0x300
-	ClusterIDTemp     uint32 = 0x402
-	ClusterIDHumidity uint32 = 0x405
-	ClusterIDIASZone  uint32 = 0x500
-	ClusterIDPower    uint32 = 0x702
+	ClusterIDBasic              uint32 = 0x00
+	ClusterIDPowerConfiguration uint32 = 0x01
+	ClusterIDOnOff              uint32 = 0x06
+	ClusterIDLevel              uint32 = 0x08 // We're always exporting as brightness for now
+	ClusterIDDoorLock           uint32 = 0x101
+	ClusterIDWindowCovering     uint32 = 0x102
+	ClusterIDThermostat         uint32 = 0x201
+	ClusterIDColor              uint32 = 0x300
+	ClusterIDIlluminance        uint32 = 0x400
+	ClusterIDTemp               uint32 = 0x402
+	ClusterIDPressure           uint32 = 0x403
+	ClusterIDFlow               uint32 = 0x404
+	ClusterIDHumidity           uint32 = 0x405
+	ClusterIDOccupancy          uint32 = 0x406
+	ClusterIDIASZone            uint32 = 0x500
+	ClusterIDIASACE             uint32 = 0x501
+	ClusterIDIASWD              uint32 = 0x502
+	ClusterIDPower              uint32 = 0x702
+	ClusterIDElectrical         uint32 = 0xB04
 )
 
 type ZStackConfig struct {
@@ -31,6 +45,7 @@ type ZStackConfig struct {
 	GatewayPort    int
 	NwkmgrPort     int
 	StableFlagFile string
+	StateFile      string // where the last known state of each channel is cached
 }
 
 type Driver struct {
@@ -47,22 +62,88 @@ type Driver struct {
 
 	devicesFound int
 
+	// non-zero while we are fetching the device list, so that devices found outside of it can be told apart
+	// as having announced themselves
+	fetchingDevices int32
+
 	driverConfig DriverConfig
+
+	// guards devices, interviews and driverConfig, which are used from the interview goroutines
+	lock       sync.Mutex
+	interviews map[uint64]*interview
+
+	// the last known state of each channel, by device ID then channel ID. It changes too often to keep in
+	// the driver config, so it is saved to its own file.
+	stateCache       map[string]map[string]json.RawMessage
+	stateSavePending bool
+
+	// closed once we have connected to the Z-Stack servers
+	ready chan struct{}
 }
 
 type DriverConfig struct {
-	Devices map[string]deviceConfig
+	Devices  map[string]deviceConfig
+	Models   map[string]modelConfig // keyed by ModelIdentifier
+	Handlers map[string]bool        // enables or disables cluster handlers by name
+	ACE      aceConfig              // the panel armed and disarmed by IAS keypads and keyfobs
+
+	Version int // the version of the config, used to migrate configs saved by older versions of the driver
 }
 
+// configVersion 1 added device interviews
+const configVersion = 1
+
 type deviceConfig struct {
-	ManufacturerName string
-	ModelIdentifier  string
+	basicInfo
+	NodeType string // "router", "end-device", "sleepy-end-device" or "unknown"
+	Power    string // "mains", "battery" or "unknown"
+	PowerOn  *powerOnConfig
+	Battery  *batteryConfig
+
+	StartUpSupported map[string]bool // whether the cluster of each channel has its startup attribute, by channel ID
+
+	NoBattery bool // the Power Configuration cluster has neither the battery voltage nor percentage
+
+	ThingType string            // overrides the thing type we work out for the device
+	ZoneTypes map[string]uint32 // the IAS zone type of each endpoint, by endpoint ID
+	ZoneIDs   map[string]uint32 // the IAS zone ID we enrolled each endpoint with, by endpoint ID
+
+	// How long (in seconds) after the last motion an IAS motion sensor's alarm is cleared, 0 to never. If not set,
+	// it is cleared after 3 minutes, or never once MotionReportsClear records that the sensor clears it itself.
+	MotionTimeout      *float64
+	MotionReportsClear bool
+
+	Interview string // the last completed stage of the device's interview
+
+	// Cached so that the device can be exported at startup, before nwkmgr sends us the device list
+	NetworkAddress uint32
+	Endpoints      []endpointConfig
+}
+
+// modelConfig holds settings that apply to every device of a model
+type modelConfig struct {
+	// Export each endpoint as its own device (e.g. each gang of a multi-gang relay)
+	SplitEndpoints bool
+
+	// Overrides the thing type we work out for devices of this model
+	ThingType string
+
+	// Overrides the kind of channel the IAS zone alarm is exported as ("contact", "motion", "alarm", "button" or "presence")
+	ZoneChannel string
+
+	// How long (in seconds) after an IAS zone status change an identical one is ignored as a duplicate
+	ZoneDuplicateWindow *float64
+
+	Battery batteryConfig
 }
 
 func NewDriver(config *ZStackConfig) (*Driver, error) {
 	driver := &Driver{
-		config:  config,
-		devices: make(map[uint64]*Device),
+		config:     config,
+		devices:    make(map[uint64]*Device),
+		interviews: make(map[uint64]*interview),
+		stateCache: make(map[string]map[string]json.RawMessage),
+		ready:      make(chan struct{}),
 	}
 
 	err := driver.Init(info)
@@ -104,15 +185,36 @@ func (d *Driver) Reset(hard bool) error {
 }
 
 func (d *Driver) saveConfig() {
+	d.lock.Lock()
+	defer d.lock.Unlock()
 	d.SendEvent("config", d.driverConfig)
 }
 
+// migrateConfig updates a config saved by an older version of the driver.
+func migrateConfig(config *DriverConfig) {
+	if config.Version < 1 {
+		// Devices found before there were interviews were exported without one, so they're treated as
+		// interviewed rather than being hidden until an interview succeeds
+		for id, cfg := range config.Devices {
+			if cfg.Interview == "" {
+				cfg.Interview = interviewComplete
+				config.Devices[id] = cfg
+			}
+		}
+	}
+	config.Version = configVersion
+}
+
 func (d *Driver) Start(config DriverConfig) error {
 
 	spew.Dump("Got config", config)
 	if config.Devices == nil {
 		config.Devices = map[string]deviceConfig{}
 	}
+	if config.Models == nil {
+		config.Models = map[string]modelConfig{}
+	}
+	migrateConfig(&config)
 	d.driverConfig = config
 
 	go func() {
@@ -121,6 +223,9 @@ func (d *Driver) Start(config DriverConfig) error {
 		// required because inbound RPC start calls have arbitrary timeouts which a) we are not aware of
 		// and b) we can't guarantee to satisfy here.
 
+		d.loadStateCache()
+		d.exportCachedDevices()
+
 		err := d.startup()
 		if err != nil {
 			d.Log.Fatalf("startup failed : %v", err)
@@ -140,8 +245,10 @@ func (d *Driver) startup() error {
 	if err != nil {
 		return fmt.Errorf("Error connecting to nwkmgr %s", err)
 	}
+	// nwkmgr passes on the device indications sent when a device announces itself (after joining or rejoining)
+	// through the same callback as the device list
 	d.nwkmgrConn.OnDeviceFound = func(deviceInfo *nwkmgr.NwkDeviceInfoT) {
-		d.onDeviceFound(deviceInfo)
+		d.onDeviceFound(deviceInfo, atomic.LoadInt32(&d.fetchingDevices) == 0)
 	}
 
 	/*done := false
@@ -217,6 +324,8 @@ func (d *Driver) startup() error {
 
 	log.Debugf("Started coordinator. Channel:%d Pan ID:0x%X", *networkInfo.NwkChannel, *networkInfo.PanId)
 
+	close(d.ready)
+
 	d.StartFetchingDevices()
 
 	return nil
@@ -287,13 +396,21 @@ func (d *Driver) EnableJoin(duration uint32) error {
 func (d *Driver) StartFetchingDevices() {
 	go func() {
 		for {
-			d.nwkmgrConn.FetchDeviceList()
+			d.fetchDeviceList()
 			time.Sleep(time.Second * 30)
 		}
 	}()
 }
 
-func (d *Driver) onDeviceFound(deviceInfo *nwkmgr.NwkDeviceInfoT) {
+func (d *Driver) fetchDeviceList() error {
+	atomic.AddInt32(&d.fetchingDevices, 1)
+	defer atomic.AddInt32(&d.fetchingDevices, -1)
+
+	return d.nwkmgrConn.FetchDeviceList()
+}
+
+// onDeviceFound is called for each device in the device list, and for each device that announces itself.
+func (d *Driver) onDeviceFound(deviceInfo *nwkmgr.NwkDeviceInfoT, announced bool) {
 
 	// XXX: This device status is often wrong. Useless.
 	/*if *deviceInfo.DeviceStatus != nwkmgr.NwkDeviceStatusT_DEVICE_ON_LINE {
@@ -304,300 +421,201 @@ func (d *Driver) onDeviceFound(deviceInfo *nwkmgr.NwkDeviceInfoT) {
 		return
 	}*/
 
-	if d.devices[*deviceInfo.IeeeAddress] != nil {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if device := d.devices[*deviceInfo.IeeeAddress]; device != nil {
 		// We've seen this already, but it may have been re-paired. We *should* just be able to replace
 		// the deviceInfo object, which is used for all communication.
 		// TODO: Actually verify this. May need to re-run channel init.
-		d.devices[*deviceInfo.IeeeAddress].deviceInfo = deviceInfo
+		rejoined := !device.stale && hasRejoined(device.deviceInfo, deviceInfo, announced)
+		if device.stale {
+			d.reconcile(device, deviceInfo)
+		}
+		if d.cacheDeviceInfo(deviceInfo) {
+			go d.saveConfig()
+		}
+
+		device.deviceInfo = deviceInfo
+		for _, child := range device.children {
+			child.deviceInfo = deviceInfo
+		}
+
+		if rejoined {
+			log.Infof("Device IEEE:%X has rejoined", *deviceInfo.IeeeAddress)
+			device.rejoined()
+		}
 		return
 	}
 
-	id := fmt.Sprintf("%X", *deviceInfo.IeeeAddress)
+	// We don't export the device until we've finished interviewing it
+	d.interviewDevice(deviceInfo)
+}
+
+// exportDevice exports a device that has been interviewed, along with all its channels.
+func (d *Driver) exportDevice(deviceInfo *nwkmgr.NwkDeviceInfoT) {
 
 	device := &Device{
 		driver:     d,
 		deviceInfo: deviceInfo,
 		info: &model.Device{
-			NaturalID:     id,
+			NaturalID:     fmt.Sprintf("%X", *deviceInfo.IeeeAddress),
 			NaturalIDType: "zigbee",
 			Signatures:    &map[string]string{},
 		},
 	}
 
-	for _, endpoint := range deviceInfo.SimpleDescList {
-		if *endpoint.ProfileId == 0xC05E /*ZLL*/ {
-
-			switch *endpoint.DeviceId {
-
-			case 0x0000: // On/Off Light
-				fallthrough
-			case 0x0100: // Dimmable Light
-				fallthrough
-			case 0x0200: // Color Light
-				fallthrough
-			case 0x210: // Ext Color Light
-				(*device.info.Signatures)["ninja:thingType"] = "light"
-			}
-		}
-
-		if *endpoint.ProfileId == 0x104 /* HA */ {
-			switch *endpoint.DeviceId {
-			case 0x0100: // On/Off Light
-				fallthrough
-			case 0x0101: // Dimmable Light
-				fallthrough
-			case 0x0102: // Color Dimmable Light
-				(*device.info.Signatures)["ninja:thingType"] = "light"
-			case 0x009: // Mains Power Outlet
-				(*device.info.Signatures)["ninja:thingType"] = "socket"
-			case 0x302: // Temperature Sensor
-				(*device.info.Signatures)["ninja:thingType"] = "sensor"
-			}
-
-		}
-	}
-
-	if cfg, ok := d.driverConfig.Devices[id]; ok {
-		device.ModelIdentifier = cfg.ModelIdentifier
-		device.ManufacturerName = cfg.ManufacturerName
-	} else {
-		err := device.getBasicInfo()
-		if err != nil {
-			log.Debugf("Failed to get basic info for: %X : %s", *deviceInfo.IeeeAddress, err)
-			return
-		}
-
-		cfg = deviceConfig{
-			ModelIdentifier:  device.ModelIdentifier,
-			ManufacturerName: device.ManufacturerName,
-		}
-		d.driverConfig.Devices[id] = cfg
-		d.saveConfig()
-	}
+	device.updateInfo()
+	device.onRejoin(device.refreshBasicInfo)
+	go device.watchBuild()
 
 	name := ""
-
-	if device.ModelIdentifier != "" {
-		(*device.info.Signatures)["zigbee:ModelIdentifier"] = device.ModelIdentifier
-		name = device.ModelIdentifier
-	}
-
-	if device.ManufacturerName != "" {
-		(*device.info.Signatures)["zigbee:ManufacturerName"] = device.ManufacturerName
-		if device.ModelIdentifier != "" {
-			name += " by "
-		}
-		name += device.ManufacturerName
-	}
-
-	if device.ManufacturerName == "MRVL" && device.ModelIdentifier == "MZ100" {
-		(*device.info.Signatures)["zigbee:ManufacturerName"] = device.ManufacturerName
-		(*device.info.Signatures)["ninja:manufacturer"] = "Belkin"
-		(*device.info.Signatures)["ninja:productName"] = "WeMo Smart LED Bulb"
-		name = "WeMo Smart Bulb"
+	if device.info.Name != nil {
+		name = *device.info.Name
 	}
 
 	log.Debugf("\n\n")
 	log.Infof("---- Found Device IEEE:%X Name:%s ----\f", *deviceInfo.IeeeAddress, name)
 	log.Debugf("Device Info: %v", *deviceInfo)
 
-	if name != "" {
-		device.info.Name = &name
-	}
-
 	if log.IsDebugEnabled() {
 		spew.Dump(deviceInfo)
 	}
 
-	err = d.Conn.ExportDevice(device)
-	if err != nil {
-		log.Fatalf("Failed to export zigbee device %s: %s", name, err)
+	split := d.modelConfig(device.ModelIdentifier).SplitEndpoints && len(deviceInfo.SimpleDescList) > 1
+
+	if !split {
+		err := d.Conn.ExportDevice(device)
+		if err != nil {
+			log.Fatalf("Failed to export zigbee device %s: %s", name, err)
+		}
 	}
-	d.devicesFound++
 
+	d.lock.Lock()
+	d.devicesFound++
 	d.devices[*deviceInfo.IeeeAddress] = device
+	d.lock.Unlock()
 
-	batchChannel := &BatchChannel{
-		Channel: Channel{
-			ID:     "batch",
-			device: device,
-		},
-	}
+	// Each endpoint with a light on it gets its own batch channel. The first keeps the plain "batch" ID.
+	var batchChannels []*BatchChannel
 
 	log.Debugf("Got device : %d", *deviceInfo.IeeeAddress)
 
 	for _, endpoint := range deviceInfo.SimpleDescList {
 		log.Debugf("Got endpoint : %d", *endpoint.EndpointId)
 
-		if containsUInt32(endpoint.InputClusters, ClusterIDOnOff) {
-			log.Debugf("This endpoint has an input on/off cluster")
-
-			onOff := &OnOffChannel{
-				Channel: Channel{
-					ID:       fmt.Sprintf("%d-%d-in", *endpoint.EndpointId, ClusterIDOnOff),
-					device:   device,
-					endpoint: endpoint,
-				},
-			}
-
-			err := onOff.init()
-			if err != nil {
-				log.Debugf("Failed initialising input on/off channel: %s", err)
-			}
-
-			batchChannel.onOff = onOff
+		parent := device
+		if split {
+			device = d.exportChildDevice(parent, endpoint)
 		}
 
-		if containsUInt32(endpoint.OutputClusters, ClusterIDOnOff) {
-			log.Debugf("This endpoint has an output on/off cluster")
-
-			onOff := &OnOffSwitchCluster{
-				Channel: Channel{
-					ID:       fmt.Sprintf("%d-%d-out", *endpoint.EndpointId, ClusterIDOnOff),
-					device:   device,
-					endpoint: endpoint,
-				},
-			}
-
-			err := onOff.init()
-			if err != nil {
-				log.Debugf("Failed initialising output on/off channel: %s", err)
-			}
-
+		batchChannel := &BatchChannel{
+			Channel: Channel{
+				ID:       fmt.Sprintf("%d-batch", *endpoint.EndpointId),
+				device:   device,
+				endpoint: endpoint,
+			},
 		}
 
-		if containsUInt32(endpoint.InputClusters, ClusterIDPower) {
-			log.Debugf("This endpoint has power cluster")
+		d.exportClusterChannels(device, endpoint, batchChannel)
 
-			power := &PowerChannel{
-				Channel: Channel{
-					ID:       fmt.Sprintf("%d-%d", *endpoint.EndpointId, ClusterIDPower),
-					device:   device,
-					endpoint: endpoint,
-				},
+		if batchChannel.brightness != nil || batchChannel.color != nil {
+			if len(batchChannels) == 0 || split {
+				batchChannel.ID = "batch"
 			}
-
-			err := power.init()
-			if err != nil {
-				log.Debugf("Failed initialising power channel: %s", err)
-			}
-
+			batchChannels = append(batchChannels, batchChannel)
 		}
 
-		if containsUInt32(endpoint.InputClusters, ClusterIDTemp) {
-			log.Debugf("This endpoint has temperature cluster")
-
-			temp := &TempChannel{
-				Channel: Channel{
-					ID:       fmt.Sprintf("%d-%d", *endpoint.EndpointId, ClusterIDTemp),
-					device:   device,
-					endpoint: endpoint,
-				},
-			}
-
-			err := temp.init()
-			if err != nil {
-				log.Debugf("Failed initialising temp channel: %s", err)
-			}
-
-		}
-
-		if containsUInt32(endpoint.InputClusters, ClusterIDHumidity) {
-			log.Debugf("This endpoint has humidity cluster")
-
-			humidity := &HumidityChannel{
-				Channel: Channel{
-					ID:       fmt.Sprintf("%d-%d", *endpoint.EndpointId, ClusterIDHumidity),
-					device:   device,
-					endpoint: endpoint,
-				},
-			}
-
-			err := humidity.init()
-			if err != nil {
-				log.Debugf("Failed initialising humidity channel: %s", err)
-			}
+		device = parent
+	}
 
+	for _, batchChannel := range batchChannels {
+		if err := batchChannel.init(); err != nil {
+			log.Warningf("Failed to export batch channel: %s", err)
 		}
+	}
 
-		if containsUInt32(endpoint.InputClusters, ClusterIDLevel) {
-			log.Debugf("This endpoint has level cluster. Exporting as brightness channel")
-
-			if log.IsDebugEnabled() {
-				spew.Dump("brightness cluster", endpoint, ClusterIDLevel)
-			}
+	fmt.Printf("---- Finished Device IEEE:%X ----\n", *deviceInfo.IeeeAddress)
 
-			brightness := &BrightnessChannel{
-				Channel: Channel{
-					ID:       fmt.Sprintf("%d-%d", *endpoint.EndpointId, ClusterIDLevel),
-					device:   device,
-					endpoint: endpoint,
-				},
-			}
+}
 
-			err := brightness.init()
-			if err != nil {
-				log.Debugf("Failed initialising brightness channel: %s", err)
-			}
+// updateDeviceConfig applies and saves a change to the config of a device
+func (d *Driver) updateDeviceConfig(ieee uint64, update func(cfg *deviceConfig)) {
+	id := fmt.Sprintf("%X", ieee)
 
-			batchChannel.brightness = brightness
-		}
+	d.lock.Lock()
+	cfg := d.driverConfig.Devices[id]
+	update(&cfg)
+	d.driverConfig.Devices[id] = cfg
+	d.lock.Unlock()
 
-		if containsUInt32(endpoint.InputClusters, ClusterIDColor) {
-			log.Debugf("This endpoint has color cluster.")
+	d.saveConfig()
+}
 
-			if log.IsDebugEnabled() {
-				spew.Dump("color cluster", endpoint, ClusterIDColor)
-			}
+func (d *Driver) modelConfig(modelIdentifier string) modelConfig {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.driverConfig.Models[modelIdentifier]
+}
 
-			color := &ColorChannel{
-				Channel: Channel{
-					ID:       fmt.Sprintf("%d-%d", *endpoint.EndpointId, ClusterIDColor),
-					device:   device,
-					endpoint: endpoint,
-				},
-			}
+// exportChildDevice exports a single endpoint of a device as a device of its own.
+func (d *Driver) exportChildDevice(parent *Device, endpoint *nwkmgr.NwkSimpleDescriptorT) *Device {
 
-			err := color.init()
-			if err != nil {
-				log.Debugf("Failed initialising color channel: %s", err)
-			}
+	signatures := map[string]string{
+		"zigbee:ParentIEEE": parent.info.NaturalID,
+		"zigbee:EndpointId": fmt.Sprintf("%d", *endpoint.EndpointId),
+	}
 
-			batchChannel.color = color
+	for _, key := range []string{"zigbee:ModelIdentifier", "zigbee:ManufacturerName", "ninja:manufacturer", "ninja:productName"} {
+		if value, ok := (*parent.info.Signatures)[key]; ok {
+			signatures[key] = value
 		}
+	}
 
-		if containsUInt32(endpoint.InputClusters, ClusterIDIASZone) {
-			log.Debugf("This endpoint has IAS Zone cluster.")
+	if thingType := parent.endpointThingType(endpoint); thingType != "" {
+		signatures["ninja:thingType"] = thingType
+	}
 
-			if log.IsDebugEnabled() {
-				spew.Dump("ias zone cluster", endpoint, ClusterIDIASZone)
-			}
+	cfg, _ := parent.config()
+	for key, value := range compositionSignatures(cfg, []*nwkmgr.NwkSimpleDescriptorT{endpoint}) {
+		signatures[key] = value
+	}
 
-			color := &IASZoneCluster{
-				Channel: Channel{
-					ID:       fmt.Sprintf("%d-%d", *endpoint.EndpointId, ClusterIDIASZone),
-					device:   device,
-					endpoint: endpoint,
-				},
-			}
+	child := &Device{
+		driver:     d,
+		deviceInfo: parent.deviceInfo,
+		basicInfo:  parent.basicInfo,
+		info: &model.Device{
+			NaturalID:     fmt.Sprintf("%s-%d", parent.info.NaturalID, *endpoint.EndpointId),
+			NaturalIDType: "zigbee",
+			Signatures:    &signatures,
+		},
+	}
 
-			err := color.init()
-			if err != nil {
-				log.Debugf("Failed initialising IAS Zone channel: %s", err)
-			}
+	name := fmt.Sprintf("Endpoint %d", *endpoint.EndpointId)
+	if parent.info.Name != nil {
+		name = fmt.Sprintf("%s (%d)", *parent.info.Name, *endpoint.EndpointId)
+	}
+	child.info.Name = &name
 
-		}
+	log.Infof("Exporting endpoint %d of device IEEE:%X as %s", *endpoint.EndpointId, *parent.deviceInfo.IeeeAddress, name)
 
+	err := d.Conn.ExportDevice(child)
+	if err != nil {
+		log.Fatalf("Failed to export zigbee device %s: %s", name, err)
 	}
 
-	if batchChannel.brightness != nil || batchChannel.color != nil {
-		if err := batchChannel.init(); err != nil {
-			log.Warningf("Failed to export batch channel: %s", err)
-		}
-	}
+	parent.children = append(parent.children, child)
 
-	fmt.Printf("---- Finished Device IEEE:%X ----\n", *deviceInfo.IeeeAddress)
+	return child
+}
 
+// hasRejoined returns true if the device has left and rejoined the network (e.g. after losing power). Devices
+// announce themselves when they rejoin, usually with the same network address, so a change of address is only
+// how we spot rejoins whose announcement we missed. The device status isn't used, as it is often wrong and a
+// false rejoin would restore old state.
+func hasRejoined(previous, current *nwkmgr.NwkDeviceInfoT, announced bool) bool {
+	return announced || previous.GetNetworkAddress() != current.GetNetworkAddress()
 }
 
 func getCurDir() string {
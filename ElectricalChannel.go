@@ -0,0 +1,252 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/ninjasphere/go-ninja/api"
+	"github.com/ninjasphere/go-ninja/channels"
+	"github.com/ninjasphere/go-zigbee/gateway"
+)
+
+// ElectricalChannel publishes the RMS voltage, current, active power and power factor of a device's
+// Electrical Measurement cluster, each as its own channel. Devices that also have a Metering cluster end up with
+// two power channels: the meter's demand and the active power are each exported under their own ID, so neither
+// changes when the other is added.
+type ElectricalChannel struct {
+	Channel
+	measurements []*electricalMeasurement
+
+	// The AC multipliers and divisors are read once the device is reachable
+	formatted bool
+}
+
+// electricalMeasurement is one of the attributes of the cluster and the channel it is published on
+type electricalMeasurement struct {
+	attributeID   uint32
+	attributeType gateway.GwZclAttributeDataTypesT
+	suffix        string // appended to the channel ID
+	channel       ninja.Channel
+	send          func(state float64) error
+
+	// The attributes the value is multiplied and divided by, if any
+	multiplierID, divisorID uint32
+	scale                   float64
+}
+
+func init() {
+	registerClusterHandler(&clusterHandler{
+		name:      "electrical",
+		clusterID: ClusterIDElectrical,
+		direction: clusterInput,
+		newChannel: func(channel Channel) clusterChannel {
+			return &ElectricalChannel{Channel: channel}
+		},
+	})
+}
+
+// Attributes of the Electrical Measurement cluster
+const (
+	ElectricalAttributeRMSVoltage          uint32 = 0x0505 // uint16
+	ElectricalAttributeRMSCurrent          uint32 = 0x0508 // uint16
+	ElectricalAttributeActivePower         uint32 = 0x050B // int16
+	ElectricalAttributePowerFactor         uint32 = 0x0510 // int8, -100 to 100
+	ElectricalAttributeACVoltageMultiplier uint32 = 0x0600
+	ElectricalAttributeACVoltageDivisor    uint32 = 0x0601
+	ElectricalAttributeACCurrentMultiplier uint32 = 0x0602
+	ElectricalAttributeACCurrentDivisor    uint32 = 0x0603
+	ElectricalAttributeACPowerMultiplier   uint32 = 0x0604
+	ElectricalAttributeACPowerDivisor      uint32 = 0x0605
+)
+
+// The value each attribute type has when the device doesn't have a reading
+var invalidElectricalValues = map[gateway.GwZclAttributeDataTypesT]float64{
+	gateway.GwZclAttributeDataTypesT_ZCL_DATATYPE_UINT16: 0xFFFF,
+	gateway.GwZclAttributeDataTypesT_ZCL_DATATYPE_INT16:  -0x8000,
+	gateway.GwZclAttributeDataTypesT_ZCL_DATATYPE_INT8:   -0x80,
+}
+
+func (c *ElectricalChannel) init() error {
+	log.Debugf("Initialising electrical measurement channels of device %X", *c.device.deviceInfo.IeeeAddress)
+
+	voltage := &measurementChannel{protocol: "voltage"}
+	current := &measurementChannel{protocol: "current"}
+	power := channels.NewPowerChannel(c)
+	powerFactor := &measurementChannel{protocol: "power-factor"}
+
+	c.measurements = []*electricalMeasurement{{
+		attributeID:   ElectricalAttributeRMSVoltage,
+		attributeType: gateway.GwZclAttributeDataTypesT_ZCL_DATATYPE_UINT16,
+		suffix:        "voltage",
+		channel:       voltage,
+		send:          voltage.SendState,
+		multiplierID:  ElectricalAttributeACVoltageMultiplier,
+		divisorID:     ElectricalAttributeACVoltageDivisor,
+	}, {
+		attributeID:   ElectricalAttributeRMSCurrent,
+		attributeType: gateway.GwZclAttributeDataTypesT_ZCL_DATATYPE_UINT16,
+		suffix:        "current",
+		channel:       current,
+		send:          current.SendState,
+		multiplierID:  ElectricalAttributeACCurrentMultiplier,
+		divisorID:     ElectricalAttributeACCurrentDivisor,
+	}, {
+		attributeID:   ElectricalAttributeActivePower,
+		attributeType: gateway.GwZclAttributeDataTypesT_ZCL_DATATYPE_INT16,
+		suffix:        "power",
+		channel:       power,
+		send:          power.SendState,
+		multiplierID:  ElectricalAttributeACPowerMultiplier,
+		divisorID:     ElectricalAttributeACPowerDivisor,
+	}, {
+		attributeID:   ElectricalAttributePowerFactor,
+		attributeType: gateway.GwZclAttributeDataTypesT_ZCL_DATATYPE_INT8,
+		suffix:        "power-factor",
+		channel:       powerFactor,
+		send:          powerFactor.SendState,
+		scale:         0.01,
+	}}
+
+	for _, measurement := range c.measurements {
+		err := c.device.driver.Conn.ExportChannel(c.device, measurement.channel, c.ID+measurement.suffix)
+		if err != nil {
+			log.Fatalf("Failed to announce %s channel: %s", measurement.suffix, err)
+		}
+
+		var state float64
+		if c.device.driver.cachedState(*c.device.deviceInfo.IeeeAddress, c.ID+measurement.suffix, &state) {
+			switch channel := measurement.channel.(type) {
+			case *measurementChannel:
+				sendCachedState(channel.SendEvent, state)
+			case *channels.PowerChannel:
+				sendCachedState(channel.SendEvent, state)
+			}
+		}
+	}
+
+	go func() {
+		c.device.driver.waitUntilReady()
+		c.enableReporting()
+
+		for {
+			err := c.fetchState()
+			if err != nil {
+				log.Errorf("Failed to poll for electrical measurements %s", err)
+			}
+			time.Sleep(10 * time.Second)
+		}
+	}()
+
+	return nil
+}
+
+func (c *ElectricalChannel) enableReporting() {
+
+	clusterID := ClusterIDElectrical
+	minReportInterval := uint32(1)
+	maxReportInterval := uint32(120)
+	reportableChange := uint32(1)
+
+	attributes := []*gateway.GwAttributeReportT{}
+	for _, measurement := range c.measurements {
+		attributes = append(attributes, &gateway.GwAttributeReportT{
+			AttributeId:       &measurement.attributeID,
+			AttributeType:     measurement.attributeType.Enum(),
+			MinReportInterval: &minReportInterval,
+			MaxReportInterval: &maxReportInterval,
+			ReportableChange:  &reportableChange,
+		})
+	}
+
+	request := &gateway.GwSetAttributeReportingReq{
+		DstAddress:          c.dstAddress(),
+		ClusterId:           &clusterID,
+		AttributeReportList: attributes,
+	}
+
+	response := &gateway.GwSetAttributeReportingRspInd{}
+	err := c.device.driver.gatewayConn.SendAsyncCommand(request, response, 20*time.Second)
+	if err != nil {
+		log.Errorf("Error enabling electrical measurement reporting: %s", err)
+	} else if response.Status.String() != "STATUS_SUCCESS" {
+		log.Errorf("Failed to enable electrical measurement reporting. status: %s", response.Status.String())
+	}
+}
+
+// fetchFormatting reads the AC multipliers and divisors. Those the device doesn't have (or has set to 0) are 1.
+func (c *ElectricalChannel) fetchFormatting() error {
+
+	attributes, err := c.readAttributes(ClusterIDElectrical,
+		ElectricalAttributeACVoltageMultiplier, ElectricalAttributeACVoltageDivisor,
+		ElectricalAttributeACCurrentMultiplier, ElectricalAttributeACCurrentDivisor,
+		ElectricalAttributeACPowerMultiplier, ElectricalAttributeACPowerDivisor)
+	if err != nil {
+		return err
+	}
+
+	factor := func(attributeID uint32) float64 {
+		if attribute, ok := attributes[attributeID]; ok && attributeUint(attribute) != 0 {
+			return float64(attributeUint(attribute))
+		}
+		return 1
+	}
+
+	for _, measurement := range c.measurements {
+		if measurement.multiplierID != 0 {
+			measurement.scale = factor(measurement.multiplierID) / factor(measurement.divisorID)
+		}
+	}
+
+	c.formatted = true
+	return nil
+}
+
+func (c *ElectricalChannel) fetchState() error {
+
+	if !c.formatted {
+		if err := c.fetchFormatting(); err != nil {
+			return fmt.Errorf("Failed to read AC formatting: %s", err)
+		}
+	}
+
+	attributeIDs := []uint32{}
+	for _, measurement := range c.measurements {
+		attributeIDs = append(attributeIDs, measurement.attributeID)
+	}
+
+	attributes, err := c.readAttributes(ClusterIDElectrical, attributeIDs...)
+	if err != nil {
+		return err
+	}
+
+	if len(attributes) == 0 {
+		return fmt.Errorf("Device doesn't report any electrical measurements")
+	}
+
+	for _, measurement := range c.measurements {
+		attribute, ok := attributes[measurement.attributeID]
+		if !ok {
+			continue
+		}
+
+		var value float64
+		if measurement.attributeType == gateway.GwZclAttributeDataTypesT_ZCL_DATATYPE_UINT16 {
+			value = float64(attributeUint(attribute))
+		} else {
+			value = float64(attributeInt(attribute))
+		}
+
+		if value == invalidElectricalValues[measurement.attributeType] {
+			log.Debugf("Device %X has no %s reading", *c.device.deviceInfo.IeeeAddress, measurement.suffix)
+			continue
+		}
+
+		state := value * measurement.scale
+		log.Debugf("Got %s value %f", measurement.suffix, state)
+
+		measurement.send(state)
+		c.device.driver.cacheState(*c.device.deviceInfo.IeeeAddress, c.ID+measurement.suffix, state)
+	}
+
+	return nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/ninjasphere/go-zigbee/gateway"
+)
+
+// FlowChannel publishes the flow measured by a sensor, in m³/h.
+type FlowChannel struct {
+	Channel
+	channel *measurementChannel
+}
+
+func init() {
+	registerClusterHandler(&clusterHandler{
+		name:      "flow",
+		clusterID: ClusterIDFlow,
+		direction: clusterInput,
+		newChannel: func(channel Channel) clusterChannel {
+			return &FlowChannel{Channel: channel}
+		},
+	})
+}
+
+// The MeasuredValue of the Flow Measurement cluster, in 0.1 m³/h
+const FlowAttributeMeasuredValue uint32 = 0x0000
+
+func (c *FlowChannel) init() error {
+	log.Debugf("Initialising Flow channel of device %d", *c.device.deviceInfo.IeeeAddress)
+
+	c.channel = &measurementChannel{protocol: "flow"}
+	err := c.device.driver.Conn.ExportChannel(c.device, c.channel, c.ID)
+	if err != nil {
+		log.Fatalf("Failed to announce flow channel: %s", err)
+	}
+
+	var state float64
+	if c.cachedState(&state) {
+		sendCachedState(c.channel.SendEvent, state)
+	}
+
+	go func() {
+		c.device.driver.waitUntilReady()
+		c.enableReporting()
+
+		for {
+			err := c.fetchState()
+			if err != nil {
+				log.Errorf("Failed to poll for Flow %s", err)
+			}
+			time.Sleep(1 * time.Minute)
+		}
+	}()
+
+	return nil
+}
+
+func (c *FlowChannel) enableReporting() {
+
+	clusterID := ClusterIDFlow
+	measuredValueAttributeID := FlowAttributeMeasuredValue
+	minReportInterval := uint32(10)
+	maxReportInterval := uint32(120)
+	reportableChange := uint32(1)
+
+	request := &gateway.GwSetAttributeReportingReq{
+		DstAddress: c.dstAddress(),
+		ClusterId:  &clusterID,
+		AttributeReportList: []*gateway.GwAttributeReportT{{
+			AttributeId:       &measuredValueAttributeID,
+			AttributeType:     gateway.GwZclAttributeDataTypesT_ZCL_DATATYPE_UINT16.Enum(),
+			MinReportInterval: &minReportInterval,
+			MaxReportInterval: &maxReportInterval,
+			ReportableChange:  &reportableChange,
+		}},
+	}
+
+	response := &gateway.GwSetAttributeReportingRspInd{}
+	err := c.device.driver.gatewayConn.SendAsyncCommand(request, response, 20*time.Second)
+	if err != nil {
+		log.Errorf("Error enabling Flow reporting: %s", err)
+	} else if response.Status.String() != "STATUS_SUCCESS" {
+		log.Errorf("Failed to enable Flow reporting. status: %s", response.Status.String())
+	}
+}
+
+func (c *FlowChannel) fetchState() error {
+
+	attributes, err := c.readAttributes(ClusterIDFlow, FlowAttributeMeasuredValue)
+	if err != nil {
+		return err
+	}
+
+	attribute, ok := attributes[FlowAttributeMeasuredValue]
+	if !ok {
+		return fmt.Errorf("Flow was not returned")
+	}
+
+	value := attributeUint(attribute)
+	if value == 0xFFFF {
+		return fmt.Errorf("Device returned an invalid flow")
+	}
+
+	log.Debugf("Got Flow value %d", value)
+
+	state := float64(value) / 10
+	c.channel.SendState(state)
+	c.cacheState(state)
+
+	return nil
+}
@@ -13,9 +13,49 @@ type HumidityChannel struct {
 	channel *channels.HumidityChannel
 }
 
+func init() {
+	registerClusterHandler(&clusterHandler{
+		name:      "humidity",
+		clusterID: ClusterIDHumidity,
+		direction: clusterInput,
+		newChannel: func(channel Channel) clusterChannel {
+			return &HumidityChannel{Channel: channel}
+		},
+	})
+}
+
 func (c *HumidityChannel) init() error {
 	log.Debugf("Initialising Humidity channel of device %d", *c.device.deviceInfo.IeeeAddress)
 
+	c.channel = channels.NewHumidityChannel(c)
+	err := c.device.driver.Conn.ExportChannel(c.device, c.channel, c.ID)
+	if err != nil {
+		log.Fatalf("Failed to announce Humidity channel: %s", err)
+	}
+
+	var state float64
+	if c.cachedState(&state) {
+		sendCachedState(c.channel.SendEvent, state)
+	}
+
+	go func() {
+		c.device.driver.waitUntilReady()
+		c.enableReporting()
+
+		for {
+			err := c.fetchState()
+			if err != nil {
+				log.Errorf("Failed to poll for Humidity %s", err)
+			}
+			time.Sleep(1 * time.Minute)
+		}
+	}()
+
+	return nil
+}
+
+func (c *HumidityChannel) enableReporting() {
+
 	clusterID := ClusterIDHumidity
 	instantaneousDemandAttributeID := uint32(0x0400)
 	minReportInterval := uint32(10)
@@ -23,12 +63,8 @@ func (c *HumidityChannel) init() error {
 	reportableChange := uint32(1)
 
 	request := &gateway.GwSetAttributeReportingReq{
-		DstAddress: &gateway.GwAddressStructT{
-			AddressType: gateway.GwAddressTypeT_UNICAST.Enum(),
-			IeeeAddr:    c.device.deviceInfo.IeeeAddress,
-			EndpointId:  c.endpoint.EndpointId,
-		},
-		ClusterId: &clusterID,
+		DstAddress: c.dstAddress(),
+		ClusterId:  &clusterID,
 		AttributeReportList: []*gateway.GwAttributeReportT{{
 			AttributeId:       &instantaneousDemandAttributeID,
 			AttributeType:     gateway.GwZclAttributeDataTypesT_ZCL_DATATYPE_INT24.Enum(),
@@ -45,33 +81,12 @@ func (c *HumidityChannel) init() error {
 	} else if response.Status.String() != "STATUS_SUCCESS" {
 		log.Errorf("Failed to enable Humidity reporting. status: %s", response.Status.String())
 	}
-
-	c.channel = channels.NewHumidityChannel(c)
-	err = c.device.driver.Conn.ExportChannel(c.device, c.channel, c.ID)
-	if err != nil {
-		log.Fatalf("Failed to announce Humidity channel: %s", err)
-	}
-
-	go func() {
-		for {
-			err := c.fetchState()
-			if err != nil {
-				log.Errorf("Failed to poll for Humidity %s", err)
-			}
-			time.Sleep(1 * time.Minute)
-		}
-	}()
-
-	return nil
 }
 
 func (c *HumidityChannel) fetchState() error {
 
 	request := &gateway.DevGetHumidityReq{
-		DstAddress: &gateway.GwAddressStructT{
-			AddressType: gateway.GwAddressTypeT_UNICAST.Enum(),
-			IeeeAddr:    c.device.deviceInfo.IeeeAddress,
-		},
+		DstAddress: c.dstAddress(),
 	}
 
 	response := &gateway.DevGetHumidityRspInd{}
@@ -85,7 +100,9 @@ func (c *HumidityChannel) fetchState() error {
 
 	log.Debugf("Got Humidity value %d", *response.HumidityValue)
 
-	c.channel.SendState(float64(*response.HumidityValue) / 0x2710)
+	state := float64(*response.HumidityValue) / 0x2710
+	c.channel.SendState(state)
+	c.cacheState(state)
 
 	return nil
 }
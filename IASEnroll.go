@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/ninjasphere/go-zigbee/gateway"
+)
+
+// Attributes of the IAS Zone cluster used for enrollment
+const (
+	IASZoneAttributeCIEAddress uint32 = 0x0010
+	IASZoneAttributeZoneID     uint32 = 0x0011
+)
+
+// Commands of the IAS Zone cluster used for enrollment
+const (
+	IASZoneCommandEnrollResponse uint32 = 0x00 // sent by us
+	IASZoneCommandEnrollRequest  uint32 = 0x01 // sent by the zone
+)
+
+const (
+	zoneEnrollSuccess = 0x00
+	maxZoneID         = 0xFE // 0xFF means no zone ID
+)
+
+// zoneEnrollment is sent as the "enrollment" event of the zone status channel, for diagnostics
+type zoneEnrollment struct {
+	Enrolled bool   `json:"enrolled"`
+	ZoneID   uint32 `json:"zoneId"`
+}
+
+// zoneID returns the zone ID of an endpoint of a device, allocating the lowest free one if it doesn't have one.
+func (d *Driver) zoneID(ieee uint64, endpointID uint32) (uint32, error) {
+	id := fmt.Sprintf("%X", ieee)
+	endpoint := fmt.Sprintf("%d", endpointID)
+
+	d.lock.Lock()
+
+	cfg := d.driverConfig.Devices[id]
+	if zoneID, ok := cfg.ZoneIDs[endpoint]; ok {
+		d.lock.Unlock()
+		return zoneID, nil
+	}
+
+	used := make(map[uint32]bool)
+	for _, device := range d.driverConfig.Devices {
+		for _, zoneID := range device.ZoneIDs {
+			used[zoneID] = true
+		}
+	}
+
+	zoneID := uint32(0)
+	for used[zoneID] {
+		zoneID++
+	}
+	if zoneID > maxZoneID {
+		d.lock.Unlock()
+		return 0, fmt.Errorf("All zone IDs are in use")
+	}
+
+	if cfg.ZoneIDs == nil {
+		cfg.ZoneIDs = make(map[string]uint32)
+	}
+	cfg.ZoneIDs[endpoint] = zoneID
+	d.driverConfig.Devices[id] = cfg
+
+	d.lock.Unlock()
+
+	log.Infof("Allocated zone ID %d to endpoint %d of device %s", zoneID, endpointID, id)
+	d.saveConfig()
+
+	return zoneID, nil
+}
+
+// enrollZone makes us the zone's CIE (the device its alarms are sent to) and enrolls it with its zone ID. Many
+// zones don't send any status changes until they have been enrolled.
+func (c *Channel) enrollZone() (*zoneEnrollment, error) {
+
+	zoneID, err := c.device.driver.zoneID(*c.device.deviceInfo.IeeeAddress, *c.endpoint.EndpointId)
+	if err != nil {
+		return nil, err
+	}
+
+	attributes, err := c.readAttributes(ClusterIDIASZone, IASZoneAttributeZoneState, IASZoneAttributeCIEAddress, IASZoneAttributeZoneID)
+	if err != nil {
+		return nil, err
+	}
+
+	cieAddress := uint64Bytes(*c.device.driver.localDevice.IeeeAddress)
+
+	enrolled := func() bool {
+		state, ok := attributes[IASZoneAttributeZoneState]
+		if !ok || attributeUint(state) != 1 {
+			return false
+		}
+		address, ok := attributes[IASZoneAttributeCIEAddress]
+		if !ok || !bytes.Equal(address.AttributeValue, cieAddress) {
+			return false
+		}
+		id, ok := attributes[IASZoneAttributeZoneID]
+		return ok && uint32(attributeUint(id)) == zoneID
+	}
+
+	if enrolled() {
+		return &zoneEnrollment{true, zoneID}, nil
+	}
+
+	log.Infof("Enrolling IAS zone on endpoint %d of device %X with zone ID %d", *c.endpoint.EndpointId, *c.device.deviceInfo.IeeeAddress, zoneID)
+
+	err = c.writeAttribute(ClusterIDIASZone, IASZoneAttributeCIEAddress, gateway.GwZclAttributeDataTypesT_ZCL_DATATYPE_IEEE_ADDR, cieAddress)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to write CIE address: %s", err)
+	}
+
+	// Zones that use "auto-enroll-response" wait for this rather than sending an enroll request
+	err = c.sendEnrollResponse(zoneID)
+	if err != nil {
+		return nil, err
+	}
+
+	attributes, err = c.readAttributes(ClusterIDIASZone, IASZoneAttributeZoneState, IASZoneAttributeCIEAddress, IASZoneAttributeZoneID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &zoneEnrollment{enrolled(), zoneID}, nil
+}
+
+// sendEnrollResponse sends an unsolicited enroll response, for zones that use "auto-enroll-response". Enroll
+// requests are answered with sendResponse instead, so that the response has the request's sequence number.
+func (c *Channel) sendEnrollResponse(zoneID uint32) error {
+	return c.sendCommand(ClusterIDIASZone, IASZoneCommandEnrollResponse, []byte{zoneEnrollSuccess, byte(zoneID)})
+}
+
+// handleZoneFrames answers the zone enroll requests a zone sends once it has our CIE address, and passes on the
+// status change notifications it sends as ZCL frames.
+func (c *IASZoneCluster) handleZoneFrames(notifications chan<- *IASZoneStatusChange) {
+
+	frames := c.device.driver.gatewayConn.OnBoundCluster(*c.device.deviceInfo.IeeeAddress, *c.endpoint.EndpointId, ClusterIDIASZone)
+
+	for frame := range frames {
+		if frame.GetClientServerDirection() != gateway.GwClientServerDirT_SERVER_TO_CLIENT {
+			continue
+		}
+
+		if frame.GetCommandId() == IASZoneCommandStatusChangeNotification {
+			change, err := parseZoneStatusChange(frame)
+			if err != nil {
+				log.Warningf("Failed to parse status change from device %X: %s", *c.device.deviceInfo.IeeeAddress, err)
+				continue
+			}
+			notifications <- change
+			continue
+		}
+
+		if frame.GetCommandId() != IASZoneCommandEnrollRequest {
+			continue
+		}
+
+		zoneID, err := c.device.driver.zoneID(*c.device.deviceInfo.IeeeAddress, *c.endpoint.EndpointId)
+		if err != nil {
+			log.Warningf("Failed to answer enroll request from device %X: %s", *c.device.deviceInfo.IeeeAddress, err)
+			continue
+		}
+
+		log.Infof("Enroll request from endpoint %d of device %X. Zone ID is %d", *c.endpoint.EndpointId, *c.device.deviceInfo.IeeeAddress, zoneID)
+
+		if err := c.sendResponse(frame, IASZoneCommandEnrollResponse, []byte{zoneEnrollSuccess, byte(zoneID)}); err != nil {
+			log.Warningf("Failed to answer enroll request from device %X: %s", *c.device.deviceInfo.IeeeAddress, err)
+			continue
+		}
+
+		c.status.SendEvent("enrollment", &zoneEnrollment{true, zoneID})
+	}
+}
+
+// checkEnrollment enrolls the zone if it isn't already, and sends the result as the "enrollment" event.
+func (c *IASZoneCluster) checkEnrollment() {
+	enrollment, err := c.enrollZone()
+	if err != nil {
+		log.Warningf("Failed to enroll IAS zone of device %X: %s", *c.device.deviceInfo.IeeeAddress, err)
+		return
+	}
+
+	if !enrollment.Enrolled {
+		log.Warningf("IAS zone on endpoint %d of device %X is not enrolled", *c.endpoint.EndpointId, *c.device.deviceInfo.IeeeAddress)
+	}
+
+	c.status.SendEvent("enrollment", enrollment)
+}
+
+// parseZoneStatusChange reads a zone status change notification: the zone status (2 bytes), extended status, zone
+// ID and delay (2 bytes, not sent by older zones).
+func parseZoneStatusChange(frame *gateway.GwZclFrameReceiveInd) (*IASZoneStatusChange, error) {
+	payload := frame.Payload
+	if len(payload) < 3 {
+		return nil, fmt.Errorf("Payload is too short (%d bytes)", len(payload))
+	}
+
+	change := &IASZoneStatusChange{
+		ZoneStatus:     uint32(payload[0]) | uint32(payload[1])<<8,
+		ExtendedStatus: uint32(payload[2]),
+		SequenceNumber: frame.SequenceNumber,
+	}
+	if len(payload) >= 6 {
+		change.Delay = uint32(payload[4]) | uint32(payload[5])<<8
+	}
+
+	return change, nil
+}
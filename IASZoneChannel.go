@@ -1,18 +1,191 @@
 package main
 
 import (
+	"fmt"
 	"reflect"
+	"sync"
+	"time"
 
 	"github.com/ninjasphere/go-ninja/channels"
+	"github.com/ninjasphere/go-zigbee/nwkmgr"
 )
 
-// TODO: This should check if this is a motion or presence sensor, and output channels accordingly.
-// TODO: This should expose battery alarm
-// TODO: This should expose tamper alarm
-// BUG: Multiple status events are being received for a single actual event sent from the device
 type IASZoneCluster struct {
 	Channel
-	presence *channels.PresenceChannel
+	kind      string
+	alarm     zoneAlarm
+	lastAlarm *bool
+	status    *zoneStatusChannel
+
+	// We often receive the same status change more than once for a single event sent from the device
+	sync.Mutex
+	lastStatus   *IASZoneStatusChange
+	lastStatusAt time.Time
+	diagnostics  zoneDiagnostics
+
+	// Motion sensors that don't send their own clear have it sent for them after a timeout
+	deviceAlarm bool
+	clearTimer  *time.Timer
+}
+
+// How long after the last motion we clear it, for sensors that haven't been seen clearing it themselves, unless
+// set for the device
+const defaultMotionTimeout = 3 * time.Minute
+
+// IASZoneStatusChange is a zone status change notification. The gateway's own indication doesn't have the ZCL
+// sequence number or the delay, so those are only known for notifications we receive as ZCL frames.
+type IASZoneStatusChange struct {
+	ZoneStatus     uint32
+	ExtendedStatus uint32
+	Delay          uint32  // quarter seconds since the status changed
+	SequenceNumber *uint32 // nil if not known
+}
+
+// sameStatus returns whether two notifications report the same status, ignoring the delay and sequence number
+func (s *IASZoneStatusChange) sameStatus(other *IASZoneStatusChange) bool {
+	return s.ZoneStatus == other.ZoneStatus && s.ExtendedStatus == other.ExtendedStatus
+}
+
+// How long after a status change an identical one is considered a duplicate, unless set for the model
+const defaultZoneDuplicateWindow = 2 * time.Second
+
+// zoneDiagnostics counts the status changes received by a zone, returned by the Diagnostics method of the
+// zone status channel.
+type zoneDiagnostics struct {
+	Received   uint64 `json:"received"`
+	Duplicates uint64 `json:"duplicates"` // suppressed as duplicates of the previous notification
+	Unchanged  uint64 `json:"unchanged"`  // repeated the previous status, but outside the duplicate window
+}
+
+// zoneAlarm is the channel that Alarm1 of a zone is sent to
+type zoneAlarm interface {
+	SendState(alarm bool) error
+}
+
+// The kind of channel that the alarm of each zone type is exported as. Zones we don't know (or whose type we
+// haven't read) are exported as presence.
+var zoneChannels = map[uint32]string{
+	0x0000: "alarm",   // Standard CIE
+	0x000D: "motion",  // Motion Sensor
+	0x0015: "contact", // Contact Switch
+	0x0028: "alarm",   // Fire Sensor
+	0x002A: "alarm",   // Water Sensor
+	0x002B: "alarm",   // Carbon Monoxide Sensor
+	0x002C: "button",  // Personal Emergency Device
+	0x002D: "alarm",   // Vibration/Movement Sensor
+	0x010F: "button",  // Remote Control
+	0x0115: "button",  // Key Fob
+	0x0226: "alarm",   // Glass Break Sensor
+}
+
+// zoneChannel exports the alarm of a zone as a contact, motion, alarm or button channel.
+type zoneChannel struct {
+	protocol  string
+	SendEvent func(event string, payload ...interface{}) error
+}
+
+func (c *zoneChannel) SetEventHandler(handler func(event string, payload ...interface{}) error) {
+	c.SendEvent = handler
+}
+
+func (c *zoneChannel) GetProtocol() string {
+	return c.protocol
+}
+
+// zoneFlags are the parts of the zone status other than the main alarm
+type zoneFlags struct {
+	Alarm2  bool `json:"alarm2"`
+	Tamper  bool `json:"tamper"`
+	Battery bool `json:"battery"` // low battery
+	Trouble bool `json:"trouble"`
+	AC      bool `json:"ac"` // mains power fault
+}
+
+// The events sent when each flag is set and cleared
+var zoneFlagEvents = []struct {
+	set      string
+	restored string
+	value    func(flags *zoneFlags) bool
+}{
+	{"alarm2", "alarm2-restored", func(f *zoneFlags) bool { return f.Alarm2 }},
+	{"tamper", "tamper-restored", func(f *zoneFlags) bool { return f.Tamper }},
+	{"low-battery", "battery-restored", func(f *zoneFlags) bool { return f.Battery }},
+	{"trouble", "trouble-restored", func(f *zoneFlags) bool { return f.Trouble }},
+	{"ac-fault", "ac-restored", func(f *zoneFlags) bool { return f.AC }},
+}
+
+// zoneStatusChannel sends the tamper, low battery, trouble, mains fault and Alarm2 flags of a zone as its state,
+// along with an event each time one of them is set or cleared.
+type zoneStatusChannel struct {
+	Channel
+	zone      *IASZoneCluster
+	last      *zoneFlags
+	SendEvent func(event string, payload ...interface{}) error
+}
+
+// Diagnostics returns the counts of status changes received and suppressed
+func (c *zoneStatusChannel) Diagnostics() (*zoneDiagnostics, error) {
+	c.zone.Lock()
+	defer c.zone.Unlock()
+	diagnostics := c.zone.diagnostics
+	return &diagnostics, nil
+}
+
+func (c *zoneStatusChannel) SetEventHandler(handler func(event string, payload ...interface{}) error) {
+	c.SendEvent = handler
+}
+
+func (c *zoneStatusChannel) GetProtocol() string {
+	return "ias-zone-status"
+}
+
+func (c *zoneStatusChannel) update(status *IASZoneStatus) {
+	flags := &zoneFlags{
+		Alarm2:  status.Alarm2,
+		Tamper:  status.Tamper,
+		Battery: status.Battery,
+		Trouble: status.Trouble,
+		AC:      status.AC,
+	}
+
+	if c.last != nil && *c.last == *flags {
+		return
+	}
+
+	if c.SendEvent != nil {
+		for _, flag := range zoneFlagEvents {
+			was := c.last != nil && flag.value(c.last)
+			is := flag.value(flags)
+
+			switch {
+			case is && !was:
+				log.Infof("IAS zone %s of device %X: %s", c.ID, *c.device.deviceInfo.IeeeAddress, flag.set)
+				c.SendEvent(flag.set, true)
+			case was && !is:
+				log.Infof("IAS zone %s of device %X: %s", c.ID, *c.device.deviceInfo.IeeeAddress, flag.restored)
+				c.SendEvent(flag.restored, true)
+			}
+		}
+
+		c.SendEvent("state", flags)
+	}
+
+	c.last = flags
+	c.cacheState(flags)
+}
+
+func (c *zoneChannel) SendState(alarm bool) error {
+	if c.SendEvent == nil {
+		return nil
+	}
+	if c.protocol == "button-momentary" {
+		// Buttons only tell us when they're pressed
+		if alarm {
+			return c.SendEvent("pressed", true)
+		}
+		return nil
+	}
+	return c.SendEvent("state", alarm)
 }
 
 type IASZoneStatus struct {
@@ -34,30 +207,326 @@ type IASZoneStatus struct {
 	Reserved8          bool
 }
 
+func init() {
+	registerClusterHandler(&clusterHandler{
+		name:      "ias-zone",
+		clusterID: ClusterIDIASZone,
+		direction: clusterInput,
+		interview: interviewZone,
+		newChannel: func(channel Channel) clusterChannel {
+			return &IASZoneCluster{Channel: channel}
+		},
+	})
+}
+
+// Attributes of the IAS Zone cluster
+const (
+	IASZoneAttributeZoneState  uint32 = 0x0000
+	IASZoneAttributeZoneType   uint32 = 0x0001
+	IASZoneAttributeZoneStatus uint32 = 0x0002
+)
+
+// IASZoneCommandStatusChangeNotification is sent by the zone when its status changes
+const IASZoneCommandStatusChangeNotification uint32 = 0x00
+
+// interviewZone reads the zone type, and enrolls the zone while it is awake after joining.
+func interviewZone(device *Device, endpoint *nwkmgr.NwkSimpleDescriptorT) error {
+
+	channel := &Channel{
+		device:   device,
+		endpoint: endpoint,
+	}
+
+	// Sleepy sensors often miss the read. Without a zone type the zone is classified by its clusters, so
+	// this doesn't fail the interview either.
+	if err := channel.readZoneType(); err != nil {
+		log.Infof("Failed to read IAS zone type of device %X: %s", *device.deviceInfo.IeeeAddress, err)
+	}
+
+	// The zone is enrolled again when its channels are created, so this doesn't fail the interview
+	if _, err := channel.enrollZone(); err != nil {
+		log.Infof("Failed to enroll IAS zone of device %X: %s", *device.deviceInfo.IeeeAddress, err)
+	}
+
+	return nil
+}
+
+// readZoneType finds what kind of sensor an IAS zone is (e.g. motion or contact), and saves it in the device config.
+func (c *Channel) readZoneType() error {
+
+	attributes, err := c.readAttributes(ClusterIDIASZone, IASZoneAttributeZoneType)
+	if err != nil {
+		return err
+	}
+
+	attribute, ok := attributes[IASZoneAttributeZoneType]
+	if !ok {
+		return fmt.Errorf("Zone type was not returned")
+	}
+
+	zoneType := uint32(attributeUint(attribute))
+
+	log.Infof("Endpoint %d of device %X is IAS zone type 0x%04X", *c.endpoint.EndpointId, *c.device.deviceInfo.IeeeAddress, zoneType)
+
+	c.device.driver.updateDeviceConfig(*c.device.deviceInfo.IeeeAddress, func(cfg *deviceConfig) {
+		if cfg.ZoneTypes == nil {
+			cfg.ZoneTypes = make(map[string]uint32)
+		}
+		cfg.ZoneTypes[fmt.Sprintf("%d", *c.endpoint.EndpointId)] = zoneType
+	})
+
+	return nil
+}
+
+// alarmEvents returns the event handler of the channel the alarm is exported as
+func (c *IASZoneCluster) alarmEvents() func(event string, payload ...interface{}) error {
+	switch alarm := c.alarm.(type) {
+	case *channels.PresenceChannel:
+		return alarm.SendEvent
+	case *zoneChannel:
+		return alarm.SendEvent
+	}
+	return nil
+}
+
 func (c *IASZoneCluster) init() error {
 	log.Debugf("Initialising IAS Zone cluster of device % X", *c.device.deviceInfo.IeeeAddress)
 
-	stateChange := c.device.driver.gatewayConn.OnZoneState(*c.device.deviceInfo.IeeeAddress, *c.endpoint.EndpointId)
+	kind := c.zoneChannel()
+	c.kind = kind
+
+	// Whatever its kind, the alarm keeps the ID it had when every zone was exported as presence
+	var err error
+	switch kind {
+	case "presence":
+		presence := channels.NewPresenceChannel()
+		err = c.device.driver.Conn.ExportChannel(c.device, presence, c.ID+"presence")
+		c.alarm = presence
+	case "button":
+		button := &zoneChannel{protocol: "button-momentary"}
+		err = c.device.driver.Conn.ExportChannel(c.device, button, c.ID+"presence")
+		c.alarm = button
+	default:
+		alarm := &zoneChannel{protocol: kind}
+		err = c.device.driver.Conn.ExportChannel(c.device, alarm, c.ID+"presence")
+		c.alarm = alarm
+	}
+	if err != nil {
+		log.Fatalf("Failed to announce %s channel: %s", kind, err)
+	}
+
+	var alarm bool
+	if kind != "button" && c.cachedState(&alarm) {
+		c.lastAlarm = &alarm
+		sendCachedState(c.alarmEvents(), alarm)
+	}
+
+	c.status = &zoneStatusChannel{
+		Channel: Channel{
+			ID:       c.ID + "status",
+			device:   c.device,
+			endpoint: c.endpoint,
+		},
+		zone: c,
+	}
+	err = c.device.driver.Conn.ExportChannel(c.device, c.status, c.status.ID)
+	if err != nil {
+		log.Fatalf("Failed to announce zone status channel: %s", err)
+	}
+
+	// Restores are relative to the last status we saw, even if that was before a restart
+	flags := &zoneFlags{}
+	if c.status.cachedState(flags) {
+		c.status.last = flags
+		sendCachedState(c.status.SendEvent, flags)
+	}
 
 	go func() {
+		c.device.driver.waitUntilReady()
+		stateChange := c.device.driver.gatewayConn.OnZoneState(*c.device.deviceInfo.IeeeAddress, *c.endpoint.EndpointId)
+
+		notifications := make(chan *IASZoneStatusChange)
+		go c.handleZoneFrames(notifications)
+		c.checkEnrollment()
+
 		for {
-			state := <-stateChange
+			var change *IASZoneStatusChange
+			select {
+			case state := <-stateChange:
+				change = &IASZoneStatusChange{
+					ZoneStatus:     state.GetZoneStatus(),
+					ExtendedStatus: state.GetExtendedStatus(),
+				}
+			case change = <-notifications:
+			}
+
+			if c.isDuplicate(change) {
+				continue
+			}
 
 			status := &IASZoneStatus{}
 
-			readMask(int(*state.ZoneStatus), status)
+			readMask(int(change.ZoneStatus), status)
+
+			if c.kind == "motion" {
+				c.handleMotion(status.Alarm1)
+			}
 
-			c.presence.SendState(status.Alarm1)
+			c.updateAlarm(status.Alarm1)
+			c.status.update(status)
 		}
 	}()
 
-	c.presence = channels.NewPresenceChannel()
-	err = c.device.driver.Conn.ExportChannel(c.device, c.presence, c.ID+"presence")
-	if err != nil {
-		log.Fatalf("Failed to announce presence channel: %s", err)
+	return nil
+}
+
+// updateAlarm publishes the zone's alarm if it has changed. Buttons are published every time they're pressed.
+func (c *IASZoneCluster) updateAlarm(alarm bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.kind != "button" && c.lastAlarm != nil && *c.lastAlarm == alarm {
+		return
+	}
+	c.lastAlarm = &alarm
+	c.alarm.SendState(alarm)
+	c.cacheState(alarm)
+}
+
+// handleMotion (re)starts the timer that clears the motion alarm, for sensors that don't clear it themselves.
+func (c *IASZoneCluster) handleMotion(alarm bool) {
+
+	c.Lock()
+	pending := c.clearTimer != nil && c.clearTimer.Stop()
+	c.clearTimer = nil
+	c.Unlock()
+
+	// Only a clear that beat the timer shows the sensor clears itself. Some only send one much later.
+	if !alarm && c.deviceAlarm && pending {
+		c.sawMotionClear()
 	}
+	c.deviceAlarm = alarm
 
-	return nil
+	timeout := c.motionTimeout()
+	if !alarm || timeout == 0 {
+		return
+	}
+
+	c.Lock()
+	c.clearTimer = time.AfterFunc(timeout, func() {
+		log.Debugf("No motion from device %X for %s. Clearing it", *c.device.deviceInfo.IeeeAddress, timeout)
+		c.updateAlarm(false)
+	})
+	c.Unlock()
+}
+
+// motionTimeout returns how long after the last motion it should be cleared, or 0 if it shouldn't be because the
+// sensor clears it itself. A timeout set for the device overrides what we've seen the sensor do.
+func (c *IASZoneCluster) motionTimeout() time.Duration {
+	cfg, _ := c.device.config()
+
+	if cfg.MotionTimeout != nil {
+		return time.Duration(*cfg.MotionTimeout * float64(time.Second))
+	}
+	if cfg.MotionReportsClear {
+		return 0
+	}
+	return defaultMotionTimeout
+}
+
+// sawMotionClear records that the sensor cleared its own alarm before we would have, so we stop clearing it.
+func (c *IASZoneCluster) sawMotionClear() {
+	cfg, _ := c.device.config()
+	if cfg.MotionReportsClear {
+		return
+	}
+
+	log.Infof("Motion sensor %X clears its own alarm", *c.device.deviceInfo.IeeeAddress)
+
+	c.device.driver.updateDeviceConfig(*c.device.deviceInfo.IeeeAddress, func(cfg *deviceConfig) {
+		cfg.MotionReportsClear = true
+	})
+}
+
+// isDuplicate returns true if a status change is a repeat of the last one. A notification with the same sequence
+// number as the last is always a repeat, and one with a new sequence number never is. Without sequence numbers to
+// compare, the same status and delay within the duplicate window is a repeat.
+func (c *IASZoneCluster) isDuplicate(change *IASZoneStatusChange) bool {
+
+	window := defaultZoneDuplicateWindow
+	if seconds := c.device.driver.modelConfig(c.device.ModelIdentifier).ZoneDuplicateWindow; seconds != nil {
+		window = time.Duration(*seconds * float64(time.Second))
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	c.diagnostics.Received++
+
+	now := time.Now()
+	last := c.lastStatus
+	same := last != nil && last.sameStatus(change)
+
+	duplicate := false
+	switch {
+	case !same:
+	case last.SequenceNumber != nil && change.SequenceNumber != nil:
+		duplicate = *last.SequenceNumber == *change.SequenceNumber
+	case last.SequenceNumber == nil && change.SequenceNumber == nil:
+		duplicate = last.Delay == change.Delay && now.Sub(c.lastStatusAt) < window
+	default:
+		// The gateway's indication and the ZCL frame of the same notification
+		duplicate = now.Sub(c.lastStatusAt) < window
+	}
+
+	if duplicate {
+		c.diagnostics.Duplicates++
+		log.Debugf("Suppressed duplicate status 0x%X from IAS zone of device %X", change.ZoneStatus, *c.device.deviceInfo.IeeeAddress)
+		return true
+	}
+
+	if same {
+		c.diagnostics.Unchanged++
+	}
+
+	c.lastStatus = change
+	c.lastStatusAt = now
+
+	return false
+}
+
+// zoneChannel returns the kind of channel to export the zone's alarm as: "contact", "motion", "alarm", "button" or
+// "presence". It can be set for a model in the driver config.
+func (c *IASZoneCluster) zoneChannel() string {
+
+	if kind := c.device.driver.modelConfig(c.device.ModelIdentifier).ZoneChannel; kind != "" {
+		if validZoneChannel(kind) {
+			return kind
+		}
+		log.Warningf("Ignoring unknown zone channel %q configured for model %s", kind, c.device.ModelIdentifier)
+	}
+
+	cfg, _ := c.device.config()
+	if zoneType, ok := cfg.ZoneTypes[fmt.Sprintf("%d", *c.endpoint.EndpointId)]; ok {
+		if kind, ok := zoneChannels[zoneType]; ok {
+			return kind
+		}
+	}
+
+	return "presence"
+}
+
+// validZoneChannel returns whether a zone alarm can be exported as the given kind of channel
+func validZoneChannel(kind string) bool {
+	if kind == "presence" {
+		return true
+	}
+	for _, known := range zoneChannels {
+		if kind == known {
+			return true
+		}
+	}
+	return false
 }
 
 func readMask(mask int, target interface{}) {
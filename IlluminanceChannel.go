@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/ninjasphere/go-zigbee/gateway"
+)
+
+// IlluminanceChannel publishes the illuminance measured by a light sensor, in lux.
+type IlluminanceChannel struct {
+	Channel
+	channel *measurementChannel
+}
+
+func init() {
+	registerClusterHandler(&clusterHandler{
+		name:      "illuminance",
+		clusterID: ClusterIDIlluminance,
+		direction: clusterInput,
+		newChannel: func(channel Channel) clusterChannel {
+			return &IlluminanceChannel{Channel: channel}
+		},
+	})
+}
+
+// The MeasuredValue of the Illuminance Measurement cluster, which is 10000 * log10(lux) + 1
+const IlluminanceAttributeMeasuredValue uint32 = 0x0000
+
+func (c *IlluminanceChannel) init() error {
+	log.Debugf("Initialising Illuminance channel of device %d", *c.device.deviceInfo.IeeeAddress)
+
+	c.channel = &measurementChannel{protocol: "illuminance"}
+	err := c.device.driver.Conn.ExportChannel(c.device, c.channel, c.ID)
+	if err != nil {
+		log.Fatalf("Failed to announce illuminance channel: %s", err)
+	}
+
+	var state float64
+	if c.cachedState(&state) {
+		sendCachedState(c.channel.SendEvent, state)
+	}
+
+	go func() {
+		c.device.driver.waitUntilReady()
+		c.enableReporting()
+
+		for {
+			err := c.fetchState()
+			if err != nil {
+				log.Errorf("Failed to poll for Illuminance %s", err)
+			}
+			time.Sleep(1 * time.Minute)
+		}
+	}()
+
+	return nil
+}
+
+func (c *IlluminanceChannel) enableReporting() {
+
+	clusterID := ClusterIDIlluminance
+	measuredValueAttributeID := IlluminanceAttributeMeasuredValue
+	minReportInterval := uint32(10)
+	maxReportInterval := uint32(120)
+	reportableChange := uint32(1000) // about 25%
+
+	request := &gateway.GwSetAttributeReportingReq{
+		DstAddress: c.dstAddress(),
+		ClusterId:  &clusterID,
+		AttributeReportList: []*gateway.GwAttributeReportT{{
+			AttributeId:       &measuredValueAttributeID,
+			AttributeType:     gateway.GwZclAttributeDataTypesT_ZCL_DATATYPE_UINT16.Enum(),
+			MinReportInterval: &minReportInterval,
+			MaxReportInterval: &maxReportInterval,
+			ReportableChange:  &reportableChange,
+		}},
+	}
+
+	response := &gateway.GwSetAttributeReportingRspInd{}
+	err := c.device.driver.gatewayConn.SendAsyncCommand(request, response, 20*time.Second)
+	if err != nil {
+		log.Errorf("Error enabling Illuminance reporting: %s", err)
+	} else if response.Status.String() != "STATUS_SUCCESS" {
+		log.Errorf("Failed to enable Illuminance reporting. status: %s", response.Status.String())
+	}
+}
+
+func (c *IlluminanceChannel) fetchState() error {
+
+	attributes, err := c.readAttributes(ClusterIDIlluminance, IlluminanceAttributeMeasuredValue)
+	if err != nil {
+		return err
+	}
+
+	attribute, ok := attributes[IlluminanceAttributeMeasuredValue]
+	if !ok {
+		return fmt.Errorf("Illuminance was not returned")
+	}
+
+	value := attributeUint(attribute)
+	if value == 0xFFFF {
+		return fmt.Errorf("Device returned an invalid illuminance")
+	}
+
+	log.Debugf("Got Illuminance value %d", value)
+
+	// 0 means too dark to measure
+	state := 0.0
+	if value > 0 {
+		state = math.Pow(10, float64(value-1)/10000)
+	}
+	c.channel.SendState(state)
+	c.cacheState(state)
+
+	return nil
+}
@@ -0,0 +1,465 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ninjasphere/go-zigbee/nwkmgr"
+)
+
+// Each stage of an interview is attempted this many times, with the delay doubling after each failure
+const (
+	interviewAttempts     = 5
+	interviewInitialDelay = 5 * time.Second
+)
+
+// How long after an interview fails before we try it again (it can be retried immediately with the reinterview RPC)
+const interviewRetryDelay = 10 * time.Minute
+
+// The stages of an interview, in order. The name of the last completed stage is saved in the device config
+// so that an interview that was interrupted carries on where it left off, so new steps are added to an existing
+// stage rather than as stages of their own.
+var interviewStages = []struct {
+	name string
+	run  func(iv *interview) error
+}{
+	{"descriptors", (*interview).readDescriptors},
+	{"node", (*interview).readNodeType},
+	{"basic", (*interview).readBasicAndPower},
+	{"clusters", (*interview).readClusters},
+}
+
+const interviewComplete = "complete"
+
+// interview collects everything we need to know about a device before it is exported.
+type interview struct {
+	driver     *Driver
+	deviceInfo *nwkmgr.NwkDeviceInfoT
+	device     *Device // set if the device has already been exported, and is being reinterviewed
+	running    bool
+	failedAt   time.Time
+}
+
+// interviewStatus is sent as the "device-status" event as an interview progresses
+type interviewStatus struct {
+	IEEE   string `json:"ieee"`
+	Status string `json:"status"` // "interviewing", "interviewed" or "interview-failed"
+	Stage  string `json:"stage,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Reinterview starts the interview of a device again from the beginning, e.g. if it was paired
+// before it was fully ready, or has been updated. The ieee address is in hex.
+func (d *Driver) Reinterview(ieee string) error {
+
+	address, err := strconv.ParseUint(ieee, 16, 64)
+	if err != nil {
+		return fmt.Errorf("Invalid IEEE address '%s': %s", ieee, err)
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	iv := d.interviews[address]
+	if iv != nil && iv.running {
+		return fmt.Errorf("Device %s is already being interviewed", ieee)
+	}
+
+	if device := d.devices[address]; device != nil {
+		iv = &interview{
+			driver:     d,
+			deviceInfo: device.deviceInfo,
+			device:     device,
+		}
+		d.interviews[address] = iv
+	}
+
+	if iv == nil {
+		return fmt.Errorf("Unknown device %s", ieee)
+	}
+
+	id := fmt.Sprintf("%X", address)
+	cfg := d.driverConfig.Devices[id]
+	cfg.Interview = ""
+	d.driverConfig.Devices[id] = cfg
+
+	iv.start()
+
+	return nil
+}
+
+// interviewDevice starts the interview of a device we haven't exported yet, unless it is already
+// being interviewed or has recently failed.
+// Must be called while holding d.lock.
+func (d *Driver) interviewDevice(deviceInfo *nwkmgr.NwkDeviceInfoT) {
+
+	iv := d.interviews[*deviceInfo.IeeeAddress]
+
+	if iv == nil {
+		iv = &interview{
+			driver: d,
+		}
+		d.interviews[*deviceInfo.IeeeAddress] = iv
+	}
+
+	iv.deviceInfo = deviceInfo
+
+	if iv.running || time.Since(iv.failedAt) < interviewRetryDelay {
+		return
+	}
+
+	iv.start()
+}
+
+// Must be called while holding d.lock.
+func (iv *interview) start() {
+	iv.running = true
+	go iv.run()
+}
+
+func (iv *interview) id() string {
+	return fmt.Sprintf("%X", *iv.info().IeeeAddress)
+}
+
+// info returns the latest device info, which is updated each time nwkmgr sends us the device list
+func (iv *interview) info() *nwkmgr.NwkDeviceInfoT {
+	iv.driver.lock.Lock()
+	defer iv.driver.lock.Unlock()
+	return iv.deviceInfo
+}
+
+func (iv *interview) sendStatus(status string, stage string, err error) {
+	event := &interviewStatus{
+		IEEE:   iv.id(),
+		Status: status,
+		Stage:  stage,
+	}
+	if err != nil {
+		event.Error = err.Error()
+	}
+	iv.driver.SendEvent("device-status", event)
+}
+
+// config returns the saved config of the device being interviewed
+func (iv *interview) config() deviceConfig {
+	id := iv.id()
+	iv.driver.lock.Lock()
+	defer iv.driver.lock.Unlock()
+	return iv.driver.driverConfig.Devices[id]
+}
+
+// updateConfig applies and saves a change to the config of the device being interviewed
+func (iv *interview) updateConfig(update func(cfg *deviceConfig)) {
+	iv.driver.updateDeviceConfig(*iv.info().IeeeAddress, update)
+}
+
+func (iv *interview) run() {
+
+	completed := iv.config().Interview
+
+	// carry on after the last stage we completed
+	next := 0
+	for i, stage := range interviewStages {
+		if stage.name == completed {
+			next = i + 1
+		}
+	}
+	if completed == interviewComplete {
+		next = len(interviewStages)
+	}
+
+	if next == len(interviewStages) {
+		// We've interviewed this device before
+		iv.finish()
+		return
+	}
+
+	for _, stage := range interviewStages[next:] {
+		log.Infof("Interviewing device %s: %s", iv.id(), stage.name)
+		iv.sendStatus("interviewing", stage.name, nil)
+
+		delay := interviewInitialDelay
+		var err error
+
+		for attempt := 1; attempt <= interviewAttempts; attempt++ {
+			if err = stage.run(iv); err == nil {
+				break
+			}
+			log.Debugf("Interview of device %s failed at %s (attempt %d): %s", iv.id(), stage.name, attempt, err)
+
+			if attempt < interviewAttempts {
+				time.Sleep(delay)
+				delay *= 2
+			}
+		}
+
+		if err != nil {
+			log.Warningf("Interview of device %s failed at %s: %s", iv.id(), stage.name, err)
+			iv.sendStatus("interview-failed", stage.name, err)
+
+			iv.driver.lock.Lock()
+			iv.running = false
+			iv.failedAt = time.Now()
+			iv.driver.lock.Unlock()
+			return
+		}
+
+		iv.updateConfig(func(cfg *deviceConfig) {
+			cfg.Interview = stage.name
+		})
+	}
+
+	iv.updateConfig(func(cfg *deviceConfig) {
+		cfg.Interview = interviewComplete
+	})
+
+	log.Infof("Interview of device %s complete", iv.id())
+	iv.sendStatus("interviewed", "", nil)
+
+	iv.finish()
+}
+
+// finish exports the device, or updates it if it was already exported.
+func (iv *interview) finish() {
+	deviceInfo := iv.info()
+
+	iv.driver.lock.Lock()
+	delete(iv.driver.interviews, *deviceInfo.IeeeAddress)
+	iv.driver.cacheDeviceInfo(deviceInfo)
+	iv.driver.lock.Unlock()
+
+	iv.driver.saveConfig()
+
+	if iv.device != nil {
+		iv.device.republish()
+		return
+	}
+
+	iv.driver.exportDevice(deviceInfo)
+}
+
+// readDescriptors checks the device's active endpoints, then their simple descriptors.
+func (iv *interview) readDescriptors() error {
+	if err := iv.checkEndpoints(); err != nil {
+		return err
+	}
+	return iv.checkDescriptors()
+}
+
+// readBasicAndPower reads the Basic cluster, then works out the power source (which uses it).
+func (iv *interview) readBasicAndPower() error {
+	if err := iv.readBasicInfo(); err != nil {
+		return err
+	}
+	return iv.readPower()
+}
+
+// checkEndpoints makes sure nwkmgr has found the device's active endpoints. If they're missing we ask it to
+// query the device again, and the next fetch of the device list should have them.
+func (iv *interview) checkEndpoints() error {
+
+	if len(iv.info().SimpleDescList) > 0 {
+		return nil
+	}
+
+	if err := iv.requestDescriptors(); err != nil {
+		return err
+	}
+
+	return fmt.Errorf("No endpoints found yet")
+}
+
+// checkDescriptors makes sure nwkmgr has the simple descriptor of each active endpoint, querying the device
+// again if any are incomplete.
+func (iv *interview) checkDescriptors() error {
+
+	for _, endpoint := range iv.info().SimpleDescList {
+		if endpoint.ProfileId != nil && endpoint.DeviceId != nil && len(endpoint.InputClusters)+len(endpoint.OutputClusters) > 0 {
+			continue
+		}
+
+		if err := iv.requestDescriptors(); err != nil {
+			return err
+		}
+
+		return fmt.Errorf("Simple descriptor of endpoint %d is incomplete", endpoint.GetEndpointId())
+	}
+
+	return nil
+}
+
+// requestDescriptors asks nwkmgr to query the device's active endpoints and their simple descriptors again.
+func (iv *interview) requestDescriptors() error {
+
+	request := &nwkmgr.NwkDeviceListMaintenanceReq{
+		DstAddr: &nwkmgr.NwkAddressStructT{
+			AddressType: nwkmgr.NwkAddressTypeT_UNICAST.Enum(),
+			IeeeAddr:    iv.info().IeeeAddress,
+		},
+	}
+
+	response := &nwkmgr.NwkZigbeeGenericCnf{}
+	err := iv.driver.nwkmgrConn.SendCommand(request, response)
+	if err != nil {
+		return fmt.Errorf("Error requesting device descriptors: %s", err)
+	}
+	if response.Status.String() != "STATUS_SUCCESS" {
+		return fmt.Errorf("Failed to request device descriptors. status: %s", response.Status.String())
+	}
+
+	return nil
+}
+
+// readNodeType finds whether the device is a router or an end device. nwkmgr doesn't give us the device's
+// node descriptor, so it comes from the neighbor table of the coordinator or, if the device isn't one of its
+// neighbors, that of the device's parent.
+func (iv *interview) readNodeType() error {
+
+	deviceInfo := iv.info()
+
+	nodeType, err := iv.driver.getNodeType(*iv.driver.localDevice.IeeeAddress, *deviceInfo.IeeeAddress)
+	if err != nil {
+		return err
+	}
+
+	parent := deviceInfo.GetParentIeeeAddress()
+	if nodeType == "unknown" && parent != 0 && parent != *iv.driver.localDevice.IeeeAddress {
+		nodeType, err = iv.driver.getNodeType(parent, *deviceInfo.IeeeAddress)
+		if err != nil {
+			return err
+		}
+	}
+
+	iv.updateConfig(func(cfg *deviceConfig) {
+		cfg.NodeType = nodeType
+	})
+
+	return nil
+}
+
+func (iv *interview) readBasicInfo() error {
+
+	device := &Device{
+		driver:     iv.driver,
+		deviceInfo: iv.info(),
+	}
+
+	err := device.getBasicInfo()
+	if err != nil {
+		return err
+	}
+
+	// Some devices don't have either name. They're exported without one, as they always were.
+	if device.ModelIdentifier == "" && device.ManufacturerName == "" {
+		log.Warningf("Device %s doesn't have a manufacturer name or model identifier", iv.id())
+	}
+
+	iv.updateConfig(func(cfg *deviceConfig) {
+		cfg.basicInfo = device.basicInfo
+	})
+
+	return nil
+}
+
+// readPower works out whether the device runs from mains or battery. nwkmgr doesn't give us the device's
+// power descriptor either, so this uses the Basic cluster's PowerSource if the device has it, and otherwise
+// its node type: routers are always on, so mains powered, and sleepy end devices run from battery.
+func (iv *interview) readPower() error {
+
+	cfg := iv.config()
+
+	power := "unknown"
+	switch {
+	case strings.HasPrefix(cfg.PowerSource, "battery"):
+		power = "battery"
+	case cfg.PowerSource != "" && cfg.PowerSource != "unknown":
+		power = "mains"
+	case cfg.NodeType == "router":
+		power = "mains"
+	case cfg.NodeType == "sleepy-end-device":
+		power = "battery"
+	}
+
+	iv.updateConfig(func(cfg *deviceConfig) {
+		cfg.Power = power
+	})
+
+	return nil
+}
+
+// readClusters runs any reads that the cluster handlers need done before their channels are created.
+func (iv *interview) readClusters() error {
+
+	device := &Device{
+		driver:     iv.driver,
+		deviceInfo: iv.info(),
+	}
+
+	device.basicInfo = iv.config().basicInfo
+
+	for _, endpoint := range device.deviceInfo.SimpleDescList {
+		for _, handler := range clusterHandlers {
+			if handler.interview == nil || !iv.driver.handlerEnabled(handler) || !handler.matches(device, endpoint) {
+				continue
+			}
+
+			if err := handler.interview(device, endpoint); err != nil {
+				return fmt.Errorf("Failed to interview %s cluster on endpoint %d: %s", handler.name, *endpoint.EndpointId, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// getNodeType finds whether a device is a router or an end device (and whether it sleeps) from the neighbor
+// table of another device (the router). Devices that aren't its neighbors are "unknown".
+func (d *Driver) getNodeType(router uint64, ieee uint64) (string, error) {
+
+	startIndex := uint32(0)
+
+	for {
+		request := &nwkmgr.NwkGetNeighborTableReq{
+			DstAddr: &nwkmgr.NwkAddressStructT{
+				AddressType: nwkmgr.NwkAddressTypeT_UNICAST.Enum(),
+				IeeeAddr:    &router,
+			},
+			StartIndex: &startIndex,
+		}
+
+		response := &nwkmgr.NwkGetNeighborTableRspInd{}
+		err := d.nwkmgrConn.SendAsyncCommand(request, response, 10*time.Second)
+		if err != nil {
+			return "", fmt.Errorf("Error getting neighbor table: %s", err)
+		}
+		if response.Status.String() != "STATUS_SUCCESS" {
+			return "", fmt.Errorf("Failed to get neighbor table. status: %s", response.Status.String())
+		}
+
+		for _, neighbor := range response.NeighborTableList {
+			if neighbor.GetExtendedAddress() != ieee {
+				continue
+			}
+
+			switch neighbor.GetDeviceType() {
+			case nwkmgr.NwkDeviceTypeT_COORDINATOR:
+				return "coordinator", nil
+			case nwkmgr.NwkDeviceTypeT_ROUTER:
+				return "router", nil
+			case nwkmgr.NwkDeviceTypeT_ENDDEVICE:
+				if neighbor.GetIdleRx() == nwkmgr.NwkRxOnWhenIdleT_RX_OFF {
+					return "sleepy-end-device", nil
+				}
+				return "end-device", nil
+			}
+			return "unknown", nil
+		}
+
+		startIndex += uint32(len(response.NeighborTableList))
+		if len(response.NeighborTableList) == 0 || startIndex >= response.GetNeighborTableEntries() {
+			return "unknown", nil
+		}
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"sync"
 	"time"
 
 	"github.com/ninjasphere/go-ninja/channels"
@@ -11,7 +12,85 @@ import (
 type OnOffChannel struct {
 	Channel
 	lastState *bool
+	confirmed *bool // the last state read from the device
+	lastTimer *OnOffTimer
+
+	// The timer attributes are polled while the device is on (a remote or scene can start the timer too) and
+	// until they have run down. Devices that turn out not to have them aren't asked again.
+	timerLock        sync.Mutex
+	timerRunning     bool
+	timerUnsupported bool
+
+	// the last state we were asked to set, for restoring after a power cut
+	lastCommanded *bool
+
 	channel   *channels.OnOffChannel
+	setter    *coalescer
+	sendEvent func(event string, payload ...interface{}) error
+}
+
+func init() {
+	registerClusterHandler(&clusterHandler{
+		name:      "on-off",
+		clusterID: ClusterIDOnOff,
+		direction: clusterInput,
+		idSuffix:  "-in",
+		newChannel: func(channel Channel) clusterChannel {
+			return &OnOffChannel{Channel: channel}
+		},
+	})
+}
+
+// TimedOn turns the device on, and then off again by itself once OnTime has passed. As the timer
+// runs on the device, it will still turn off even if it can no longer reach us.
+type TimedOn struct {
+	OnTime           float64 `json:"onTime"`                     // seconds
+	OffWaitTime      float64 `json:"offWaitTime,omitempty"`      // seconds after turning off during which further timed ons are ignored
+	AcceptOnlyWhenOn bool    `json:"acceptOnlyWhenOn,omitempty"` // only (re)start the timer if the device is already on
+}
+
+// OffEffect turns the device off using one of the ZLL effects.
+type OffEffect struct {
+	Effect string `json:"effect"` // "fade", "off", "dim-then-fade" or "dying-light"
+}
+
+// OnOffTimer is sent as the "timer" event when the remaining on and off wait times change.
+type OnOffTimer struct {
+	OnTime      float64 `json:"onTime"`      // seconds
+	OffWaitTime float64 `json:"offWaitTime"` // seconds
+}
+
+// The effect identifier and variant of each effect of Off With Effect
+var offEffects = map[string][]byte{
+	"fade":          {0x00, 0x00}, // fade to off in 0.8 seconds
+	"off":           {0x00, 0x01}, // no fade
+	"dim-then-fade": {0x00, 0x02}, // 50% dim down in 0.8 seconds then fade to off in 12 seconds
+	"dying-light":   {0x01, 0x00}, // 20% dim up in 0.5 seconds then fade to off in 1 second
+}
+
+// Attributes of the On/Off cluster
+const (
+	OnOffAttributeOnTime      uint32 = 0x4001
+	OnOffAttributeOffWaitTime uint32 = 0x4002
+)
+
+// onOffTimerChannel adds the timed on and off with effect commands to the exported on/off channel
+type onOffTimerChannel struct {
+	*channels.OnOffChannel
+	onOff *OnOffChannel
+}
+
+func (c *onOffTimerChannel) SetEventHandler(handler func(event string, payload ...interface{}) error) {
+	c.OnOffChannel.SetEventHandler(handler)
+	c.onOff.sendEvent = handler
+}
+
+func (c *onOffTimerChannel) TurnOnTimed(params *TimedOn) error {
+	return c.onOff.turnOnTimed(params)
+}
+
+func (c *onOffTimerChannel) TurnOffWithEffect(params *OffEffect) error {
+	return c.onOff.turnOffWithEffect(params)
 }
 
 // -------- On/Off Protocol --------
@@ -28,6 +107,10 @@ func (c *OnOffChannel) ToggleOnOff() error {
 	return c.setState(gateway.GwOnOffStateT_TOGGLE_STATE.Enum())
 }
 
+func (c *OnOffChannel) addToBatch(batch *BatchChannel) {
+	batch.onOff = c
+}
+
 func (c *OnOffChannel) SetOnOff(state bool) error {
 	if state {
 		return c.TurnOn()
@@ -68,14 +151,28 @@ func (c *OnOffChannel) init() error {
 		log.Errorf("Failed to enable on/off reporting. status: %s", response.Status.String())
 	}*/
 
+	c.setter = newCoalescer("on/off", c.fetchState, c.restoreState)
+
 	c.channel = channels.NewOnOffChannel(c)
-	err = c.device.driver.Conn.ExportChannel(c.device, c.channel, c.ID)
+	err = c.device.driver.Conn.ExportChannel(c.device, &onOffTimerChannel{c.channel, c}, c.ID)
 	if err != nil {
 		log.Fatalf("Failed to announce on/off channel: %s", err)
 	}
 
+	var state bool
+	if c.cachedState(&state) {
+		sendCachedState(c.channel.SendEvent, state)
+	}
+
 	go func() {
+		c.device.driver.waitUntilReady()
+		go c.configurePowerOn()
+
 		for {
+			if c.setter.busy() {
+				time.Sleep(10 * time.Second)
+				continue
+			}
 			log.Debugf("Polling for on/off")
 			err := c.fetchState()
 			if err != nil {
@@ -91,12 +188,84 @@ func (c *OnOffChannel) init() error {
 
 func (c *OnOffChannel) setState(state *gateway.GwOnOffStateT) error {
 
+	if *state == gateway.GwOnOffStateT_TOGGLE_STATE {
+		if c.lastState == nil {
+			// We can't coalesce a toggle if we don't know what it will do
+			if err := c.sendState(state); err != nil {
+				return err
+			}
+			return c.fetchState()
+		}
+		if *c.lastState {
+			state = gateway.GwOnOffStateT_OFF_STATE.Enum()
+		} else {
+			state = gateway.GwOnOffStateT_ON_STATE.Enum()
+		}
+	}
+
+	on := *state == gateway.GwOnOffStateT_ON_STATE
+	return c.setter.submit(func() {
+		c.lastCommanded = &on
+		c.updateState(on)
+	}, func() error {
+		return c.sendState(state)
+	})
+}
+
+func (c *OnOffChannel) turnOnTimed(params *TimedOn) error {
+
+	if params.OnTime <= 0 {
+		return fmt.Errorf("OnTime must be greater than zero")
+	}
+
+	control := byte(0x00)
+	if params.AcceptOnlyWhenOn {
+		control = 0x01
+	}
+
+	payload := []byte{control}
+	payload = append(payload, uint16Bytes(toTenths(params.OnTime))...)
+	payload = append(payload, uint16Bytes(toTenths(params.OffWaitTime))...)
+
+	err := c.setter.submit(func() {
+		if !params.AcceptOnlyWhenOn {
+			c.updateState(true)
+		}
+	}, func() error {
+		return c.sendCommand(ClusterIDOnOff, OnOffCommandOnWithTimedOff, payload)
+	})
+	if err != nil {
+		return err
+	}
+
+	c.timerLock.Lock()
+	c.timerRunning = true
+	c.timerLock.Unlock()
+	return nil
+}
+
+func (c *OnOffChannel) turnOffWithEffect(params *OffEffect) error {
+
+	payload, ok := offEffects[params.Effect]
+	if !ok {
+		return fmt.Errorf("Unknown off effect '%s'", params.Effect)
+	}
+
+	off := false
+	return c.setter.submit(func() {
+		c.lastCommanded = &off
+		c.updateState(false)
+	}, func() error {
+		return c.sendCommand(ClusterIDOnOff, OnOffCommandOffWithEffect, payload)
+	})
+}
+
+func (c *OnOffChannel) sendState(state *gateway.GwOnOffStateT) error {
+	c.device.driver.waitUntilReady()
+
 	request := &gateway.DevSetOnOffStateReq{
-		DstAddress: &gateway.GwAddressStructT{
-			AddressType: gateway.GwAddressTypeT_UNICAST.Enum(),
-			IeeeAddr:    c.device.deviceInfo.IeeeAddress,
-		},
-		State: state,
+		DstAddress: c.dstAddress(),
+		State:      state,
 	}
 
 	response := &gateway.GwZigbeeGenericRspInd{}
@@ -108,17 +277,21 @@ func (c *OnOffChannel) setState(state *gateway.GwOnOffStateT) error {
 		return fmt.Errorf("Failed to set on/off state. status: %s", response.Status.String())
 	}
 
-	c.lastState = nil
+	return nil
+}
 
-	return c.fetchState()
+// restoreState publishes the last state read from the device again, after a set has failed
+func (c *OnOffChannel) restoreState() {
+	if c.confirmed != nil {
+		c.updateState(*c.confirmed)
+	}
 }
 
 func (c *OnOffChannel) fetchState() error {
+	version := c.setter.current()
+
 	request := &gateway.DevGetOnOffStateReq{
-		DstAddress: &gateway.GwAddressStructT{
-			AddressType: gateway.GwAddressTypeT_UNICAST.Enum(),
-			IeeeAddr:    c.device.deviceInfo.IeeeAddress,
-		},
+		DstAddress: c.dstAddress(),
 	}
 
 	response := &gateway.DevGetOnOffStateRspInd{}
@@ -136,12 +309,67 @@ func (c *OnOffChannel) fetchState() error {
 		return fmt.Errorf("Failed to get on/off state. status: %s", response.Status.String())
 	}
 
-	state := *response.StateValue == gateway.GwOnOffStateValueT_ON
+	on := *response.StateValue == gateway.GwOnOffStateValueT_ON
+	c.setter.publishRead(version, func() {
+		c.confirmed = &on
+		c.updateState(on)
+	})
+
+	c.timerLock.Lock()
+	pollTimer := (on || c.timerRunning) && !c.timerUnsupported
+	c.timerLock.Unlock()
 
+	if pollTimer {
+		// Not all devices support the timer attributes, so don't treat this as failing to get the state
+		if err := c.fetchTimer(); err != nil {
+			log.Debugf("Failed to get on/off timer: %s", err)
+		}
+	}
+
+	return nil
+}
+
+func (c *OnOffChannel) fetchTimer() error {
+	attributes, err := c.readAttributes(ClusterIDOnOff, OnOffAttributeOnTime, OnOffAttributeOffWaitTime)
+	if err != nil {
+		return err
+	}
+
+	onTime, ok := attributes[OnOffAttributeOnTime]
+	if !ok {
+		c.timerLock.Lock()
+		c.timerRunning = false
+		c.timerUnsupported = true
+		c.timerLock.Unlock()
+		return fmt.Errorf("Device does not support OnTime")
+	}
+
+	timer := &OnOffTimer{
+		OnTime: float64(attributeUint(onTime)) / 10,
+	}
+	if offWaitTime, ok := attributes[OnOffAttributeOffWaitTime]; ok {
+		timer.OffWaitTime = float64(attributeUint(offWaitTime)) / 10
+	}
+
+	c.timerLock.Lock()
+	defer c.timerLock.Unlock()
+
+	c.timerRunning = timer.OnTime > 0 || timer.OffWaitTime > 0
+
+	if c.lastTimer == nil || *c.lastTimer != *timer {
+		c.lastTimer = timer
+		if c.sendEvent != nil {
+			c.sendEvent("timer", timer)
+		}
+	}
+
+	return nil
+}
+
+func (c *OnOffChannel) updateState(state bool) {
 	if c.lastState == nil || *c.lastState != state {
 		c.lastState = &state
 		c.channel.SendState(state)
+		c.cacheState(state)
 	}
-
-	return nil
 }
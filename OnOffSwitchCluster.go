@@ -1,10 +1,7 @@
 package main
 
 import (
-	"time"
-
 	"github.com/davecgh/go-spew/spew"
-	"github.com/ninjasphere/go-zigbee/nwkmgr"
 )
 
 type OnOffSwitchCluster struct {
@@ -12,6 +9,18 @@ type OnOffSwitchCluster struct {
 	SendEvent func(event string, payload ...interface{}) error
 }
 
+func init() {
+	registerClusterHandler(&clusterHandler{
+		name:      "on-off-switch",
+		clusterID: ClusterIDOnOff,
+		direction: clusterOutput,
+		idSuffix:  "-out",
+		newChannel: func(channel Channel) clusterChannel {
+			return &OnOffSwitchCluster{Channel: channel}
+		},
+	})
+}
+
 func (c *OnOffSwitchCluster) SetEventHandler(handler func(event string, payload ...interface{}) error) {
 	c.SendEvent = handler
 }
@@ -23,39 +32,16 @@ func (c *OnOffSwitchCluster) GetProtocol() string {
 func (c *OnOffSwitchCluster) init() error {
 	log.Debugf("Initialising on/off button cluster of device %d", *c.device.deviceInfo.IeeeAddress)
 
-	clusterID := uint32(0x06)
-
-	dstEndpoint := uint32(5)
-
-	bindReq := &nwkmgr.NwkSetBindingEntryReq{
-		SrcAddr: &nwkmgr.NwkAddressStructT{
-			AddressType: nwkmgr.NwkAddressTypeT_UNICAST.Enum(),
-			IeeeAddr:    c.device.deviceInfo.IeeeAddress,
-			EndpointId:  c.endpoint.EndpointId,
-		},
-		ClusterId: &clusterID,
-		DstAddr: &nwkmgr.NwkAddressStructT{
-			AddressType: nwkmgr.NwkAddressTypeT_UNICAST.Enum(),
-			IeeeAddr:    c.device.driver.localDevice.IeeeAddress,
-			EndpointId:  &dstEndpoint,
-		},
-		BindingMode: nwkmgr.NwkBindingModeT_BIND.Enum(),
-	}
-
-	log.Infof("Binding on-off cluster %v", bindReq)
-
-	bindRes := &nwkmgr.NwkSetBindingEntryRspInd{}
-
-	err := c.device.driver.nwkmgrConn.SendAsyncCommand(bindReq, bindRes, time.Second*10)
+	err := c.device.driver.Conn.ExportChannel(c.device, c, c.ID)
 	if err != nil {
-		log.Errorf("Error binding on/off cluster: %s", err)
-	} else if bindRes.Status.String() != "STATUS_SUCCESS" {
-		log.Errorf("Failed to bind on/off cluster. status: %s", bindRes.Status.String())
+		log.Fatalf("Failed to announce on/off switch channel: %s", err)
 	}
 
-	update := c.device.driver.gatewayConn.OnBoundCluster(*c.device.deviceInfo.IeeeAddress, *c.endpoint.EndpointId, clusterID)
-
 	go func() {
+		c.device.driver.waitUntilReady()
+
+		update := c.bindCluster(ClusterIDOnOff)
+
 		for {
 			state := <-update
 
@@ -65,11 +51,6 @@ func (c *OnOffSwitchCluster) init() error {
 		}
 	}()
 
-	err = c.device.driver.Conn.ExportChannel(c.device, c, c.ID)
-	if err != nil {
-		log.Fatalf("Failed to announce on/off switch channel: %s", err)
-	}
-
 	return nil
 
 }
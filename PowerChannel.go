@@ -8,33 +8,123 @@ import (
 	"github.com/ninjasphere/go-zigbee/gateway"
 )
 
+// PowerChannel publishes the instantaneous demand of a meter (Metering cluster) in watts, and exports an
+// energy channel with the total delivered in kWh. Meters that measure something other than electricity (or
+// use another unit) aren't published at all.
 type PowerChannel struct {
 	Channel
 	channel *channels.PowerChannel
+	energy  *measurementChannel
+
+	// The formatting of the meter's values, read once it is reachable
+	formatted  bool
+	multiplier float64
+	divisor    float64
+
+	// Whether the meter measures in kWh (and kW). Neither is published in other units.
+	unitSupported bool
+}
+
+func init() {
+	registerClusterHandler(&clusterHandler{
+		name:      "power",
+		clusterID: ClusterIDPower,
+		direction: clusterInput,
+		newChannel: func(channel Channel) clusterChannel {
+			return &PowerChannel{Channel: channel}
+		},
+	})
 }
 
+// Attributes of the Metering cluster
+const (
+	MeteringAttributeCurrentSummationDelivered uint32 = 0x0000
+	MeteringAttributeUnitOfMeasure             uint32 = 0x0300
+	MeteringAttributeMultiplier                uint32 = 0x0301
+	MeteringAttributeDivisor                   uint32 = 0x0302
+	MeteringAttributeInstantaneousDemand       uint32 = 0x0400
+)
+
+// The UnitOfMeasure of electricity meters. The same unit with the high bit set means the meter's display
+// uses BCD, which doesn't change the attribute values.
+const meteringUnitKilowattHours = 0x00
+
 func (c *PowerChannel) init() error {
 	log.Debugf("Initialising power channel of device %d", *c.device.deviceInfo.IeeeAddress)
 
+	c.channel = channels.NewPowerChannel(c)
+	err := c.device.driver.Conn.ExportChannel(c.device, c.channel, c.ID)
+	if err != nil {
+		log.Fatalf("Failed to announce power channel: %s", err)
+	}
+
+	var state float64
+	if c.cachedState(&state) {
+		sendCachedState(c.channel.SendEvent, state)
+	}
+
+	// The energy channel is only exported once we know the meter's unit, unless we have published its energy before
+	var energy float64
+	if c.device.driver.cachedState(*c.device.deviceInfo.IeeeAddress, c.ID+"energy", &energy) {
+		c.exportEnergy()
+		sendCachedState(c.energy.SendEvent, energy)
+	}
+
+	go func() {
+		c.device.driver.waitUntilReady()
+		c.enableReporting()
+
+		for {
+			log.Debugf("Polling for power")
+			err := c.fetchState()
+			if err != nil {
+				log.Errorf("Failed to poll for power level %s", err)
+			}
+			time.Sleep(10 * time.Second)
+		}
+	}()
+
+	return nil
+}
+
+func (c *PowerChannel) exportEnergy() {
+	if c.energy != nil {
+		return
+	}
+
+	c.energy = &measurementChannel{protocol: "energy"}
+	err := c.device.driver.Conn.ExportChannel(c.device, c.energy, c.ID+"energy")
+	if err != nil {
+		log.Fatalf("Failed to announce energy channel: %s", err)
+	}
+}
+
+func (c *PowerChannel) enableReporting() {
+
 	clusterID := ClusterIDPower
-	instantaneousDemandAttributeID := uint32(0x0400)
+	demandAttributeID := MeteringAttributeInstantaneousDemand
+	summationAttributeID := MeteringAttributeCurrentSummationDelivered
 	minReportInterval := uint32(1)
 	maxReportInterval := uint32(120)
+	minSummationInterval := uint32(60)
+	maxSummationInterval := uint32(3600)
 	reportableChange := uint32(1)
 
 	request := &gateway.GwSetAttributeReportingReq{
-		DstAddress: &gateway.GwAddressStructT{
-			AddressType: gateway.GwAddressTypeT_UNICAST.Enum(),
-			IeeeAddr:    c.device.deviceInfo.IeeeAddress,
-			EndpointId:  c.endpoint.EndpointId,
-		},
-		ClusterId: &clusterID,
+		DstAddress: c.dstAddress(),
+		ClusterId:  &clusterID,
 		AttributeReportList: []*gateway.GwAttributeReportT{{
-			AttributeId:       &instantaneousDemandAttributeID,
+			AttributeId:       &demandAttributeID,
 			AttributeType:     gateway.GwZclAttributeDataTypesT_ZCL_DATATYPE_INT24.Enum(),
 			MinReportInterval: &minReportInterval,
 			MaxReportInterval: &maxReportInterval,
 			ReportableChange:  &reportableChange,
+		}, {
+			AttributeId:       &summationAttributeID,
+			AttributeType:     gateway.GwZclAttributeDataTypesT_ZCL_DATATYPE_UINT48.Enum(),
+			MinReportInterval: &minSummationInterval,
+			MaxReportInterval: &maxSummationInterval,
+			ReportableChange:  &reportableChange,
 		}},
 	}
 
@@ -45,54 +135,80 @@ func (c *PowerChannel) init() error {
 	} else if response.Status.String() != "STATUS_SUCCESS" {
 		log.Errorf("Failed to enable power reporting. status: %s", response.Status.String())
 	}
+}
 
-	c.channel = channels.NewPowerChannel(c)
-	err = c.device.driver.Conn.ExportChannel(c.device, c.channel, c.ID)
+// fetchFormatting reads the unit, multiplier and divisor that the meter's demand and summation are scaled by.
+// Meters that don't have a multiplier or divisor (or have them set to 0) use 1.
+func (c *PowerChannel) fetchFormatting() error {
+
+	attributes, err := c.readAttributes(ClusterIDPower, MeteringAttributeUnitOfMeasure, MeteringAttributeMultiplier, MeteringAttributeDivisor)
 	if err != nil {
-		log.Fatalf("Failed to announce power channel: %s", err)
+		return err
 	}
 
-	go func() {
-		for {
-			log.Debugf("Polling for power")
-			err := c.fetchState()
-			if err != nil {
-				log.Errorf("Failed to poll for power level %s", err)
-			}
-			time.Sleep(10 * time.Second)
-		}
-	}()
+	c.unitSupported = true
+	if attribute, ok := attributes[MeteringAttributeUnitOfMeasure]; ok && attributeUint(attribute)&0x7F != meteringUnitKilowattHours {
+		log.Warningf("Meter of device %X has unsupported unit of measure 0x%X. Not publishing its power or energy", *c.device.deviceInfo.IeeeAddress, attributeUint(attribute))
+		c.unitSupported = false
+	}
+
+	c.multiplier = 1
+	if attribute, ok := attributes[MeteringAttributeMultiplier]; ok && attributeUint(attribute) != 0 {
+		c.multiplier = float64(attributeUint(attribute))
+	}
+
+	c.divisor = 1
+	if attribute, ok := attributes[MeteringAttributeDivisor]; ok && attributeUint(attribute) != 0 {
+		c.divisor = float64(attributeUint(attribute))
+	}
+
+	log.Debugf("Meter of device %X has multiplier %.0f and divisor %.0f", *c.device.deviceInfo.IeeeAddress, c.multiplier, c.divisor)
+
+	if c.unitSupported {
+		c.exportEnergy()
+	}
 
+	c.formatted = true
 	return nil
 }
 
 func (c *PowerChannel) fetchState() error {
 
-	request := &gateway.DevGetPowerReq{
-		DstAddress: &gateway.GwAddressStructT{
-			AddressType: gateway.GwAddressTypeT_UNICAST.Enum(),
-			IeeeAddr:    c.device.deviceInfo.IeeeAddress,
-		},
+	if !c.formatted {
+		if err := c.fetchFormatting(); err != nil {
+			return fmt.Errorf("Failed to read meter formatting: %s", err)
+		}
 	}
 
-	response := &gateway.DevGetPowerRspInd{}
-	if c.device.driver == nil {
-		log.Fatalf("assertion failed: c.device.driver != nil")
-	}
-	if c.device.driver.gatewayConn == nil {
-		log.Fatalf("assertion failed: c.device.driver.gatewayConn != nil")
+	if !c.unitSupported {
+		return nil
 	}
-	err := c.device.driver.gatewayConn.SendAsyncCommand(request, response, 10*time.Second)
+
+	attributes, err := c.readAttributes(ClusterIDPower, MeteringAttributeInstantaneousDemand, MeteringAttributeCurrentSummationDelivered)
 	if err != nil {
-		return fmt.Errorf("Error getting power level : %s", err)
+		return err
 	}
-	if response.Status.String() != "STATUS_SUCCESS" {
-		return fmt.Errorf("Failed to get power level. status: %s", response.Status.String())
+
+	if attribute, ok := attributes[MeteringAttributeInstantaneousDemand]; ok {
+		log.Debugf("Got power value %d", attributeInt(attribute))
+
+		// Demand is in kW
+		state := float64(attributeInt(attribute)) * c.multiplier / c.divisor * 1000
+		c.channel.SendState(state)
+		c.cacheState(state)
 	}
 
-	log.Debugf("Got power value %d", *response.PowerValue)
+	if attribute, ok := attributes[MeteringAttributeCurrentSummationDelivered]; ok {
+		log.Debugf("Got energy value %d", attributeUint(attribute))
+
+		energy := float64(attributeUint(attribute)) * c.multiplier / c.divisor
+		c.energy.SendState(energy)
+		c.device.driver.cacheState(*c.device.deviceInfo.IeeeAddress, c.ID+"energy", energy)
+	}
 
-	c.channel.SendState((float64)(*response.PowerValue))
+	if len(attributes) == 0 {
+		return fmt.Errorf("Device doesn't report its demand or summation")
+	}
 
 	return nil
 }
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+
+	"github.com/ninjasphere/go-zigbee/gateway"
+)
+
+// powerOnConfig sets what a light or plug does when its power is restored (e.g. after a power cut).
+// Any value that isn't set is left as the device's default.
+type powerOnConfig struct {
+	OnOff            string   // "off", "on", "toggle" or "previous"
+	Brightness       *float64 // 0-1
+	ColorTemperature *uint32  // mireds
+
+	// Restore the state the device was in before losing power. Devices that support the startup
+	// attributes do this themselves. For those that don't, we resend the last state we commanded
+	// when we see the device rejoin.
+	RestoreLastState bool
+}
+
+// Startup attributes (ZCL 6 / ZLL)
+const (
+	OnOffAttributeStartUpOnOff                  uint32 = 0x4003
+	LevelAttributeStartUpCurrentLevel           uint32 = 0x4000
+	ColorAttributeStartUpColorTemperatureMireds uint32 = 0x4010
+)
+
+var startUpOnOffValues = map[string]byte{
+	"off":      0x00,
+	"on":       0x01,
+	"toggle":   0x02,
+	"previous": 0xFF,
+}
+
+// How long we wait to try again when we couldn't find out whether a device has a startup attribute
+const startUpRetryInterval = 5 * time.Minute
+
+// startUpSupported returns whether the channel's cluster has its startup attribute. This is only read until we
+// get an answer, which is saved in the device config, so that a device that didn't answer isn't taken as not
+// supporting it.
+func (c *Channel) startUpSupported(clusterID uint32, attributeID uint32) bool {
+	for {
+		cfg, _ := c.device.config()
+		if supported, ok := cfg.StartUpSupported[c.ID]; ok {
+			return supported
+		}
+
+		attributes, err := c.readAttributes(clusterID, attributeID)
+		if err != nil {
+			log.Infof("Failed to read startup attribute 0x%X of cluster 0x%X on device %X: %s", attributeID, clusterID, *c.device.deviceInfo.IeeeAddress, err)
+			time.Sleep(startUpRetryInterval)
+			continue
+		}
+
+		_, supported := attributes[attributeID]
+		c.device.driver.updateDeviceConfig(*c.device.deviceInfo.IeeeAddress, func(cfg *deviceConfig) {
+			if cfg.StartUpSupported == nil {
+				cfg.StartUpSupported = make(map[string]bool)
+			}
+			cfg.StartUpSupported[c.ID] = supported
+		})
+		return supported
+	}
+}
+
+// setStartUpAttribute reads one of the startup attributes and writes it if it isn't already the wanted value.
+// An error is returned if the device doesn't support the attribute.
+func (c *Channel) setStartUpAttribute(clusterID uint32, attributeID uint32, dataType gateway.GwZclAttributeDataTypesT, value []byte) error {
+
+	attributes, err := c.readAttributes(clusterID, attributeID)
+	if err != nil {
+		return err
+	}
+
+	current, ok := attributes[attributeID]
+	if !ok {
+		return fmt.Errorf("Attribute 0x%X of cluster 0x%X is not supported", attributeID, clusterID)
+	}
+
+	if bytes.Equal(current.AttributeValue, value) {
+		return nil
+	}
+
+	log.Infof("Setting startup attribute 0x%X of cluster 0x%X on device %X to % X", attributeID, clusterID, *c.device.deviceInfo.IeeeAddress, value)
+
+	return c.writeAttribute(clusterID, attributeID, dataType, value)
+}
+
+func (c *OnOffChannel) configurePowerOn() {
+	cfg, ok := c.device.config()
+	if !ok || cfg.PowerOn == nil {
+		return
+	}
+
+	onOff := cfg.PowerOn.OnOff
+	if onOff == "" && cfg.PowerOn.RestoreLastState {
+		onOff = "previous"
+	}
+	if onOff == "" {
+		return
+	}
+
+	value, ok := startUpOnOffValues[onOff]
+	if !ok {
+		log.Warningf("Unknown power on state '%s' for device %X", onOff, *c.device.deviceInfo.IeeeAddress)
+		return
+	}
+
+	if !c.startUpSupported(ClusterIDOnOff, OnOffAttributeStartUpOnOff) {
+		log.Infof("Device %X doesn't support setting its power on state", *c.device.deviceInfo.IeeeAddress)
+		if cfg.PowerOn.RestoreLastState {
+			c.device.onRejoin(c.restoreLastCommanded)
+		}
+		return
+	}
+
+	err := c.setStartUpAttribute(ClusterIDOnOff, OnOffAttributeStartUpOnOff, gateway.GwZclAttributeDataTypesT_ZCL_DATATYPE_ENUM8, []byte{value})
+	if err != nil {
+		log.Infof("Failed to set power on state of device %X: %s", *c.device.deviceInfo.IeeeAddress, err)
+	}
+}
+
+func (c *OnOffChannel) restoreLastCommanded() {
+	if c.lastCommanded == nil {
+		return
+	}
+	log.Infof("Restoring on/off state of device %X to %t", *c.device.deviceInfo.IeeeAddress, *c.lastCommanded)
+
+	if err := c.SetOnOff(*c.lastCommanded); err != nil {
+		log.Warningf("Failed to restore on/off state: %s", err)
+	}
+}
+
+func (c *BrightnessChannel) configurePowerOn() {
+	cfg, ok := c.device.config()
+	if !ok || cfg.PowerOn == nil {
+		return
+	}
+
+	var value byte
+	switch {
+	case cfg.PowerOn.Brightness != nil:
+		value = byte(toLevel(*cfg.PowerOn.Brightness))
+	case cfg.PowerOn.RestoreLastState:
+		value = 0xFF
+	default:
+		return
+	}
+
+	if !c.startUpSupported(ClusterIDLevel, LevelAttributeStartUpCurrentLevel) {
+		log.Infof("Device %X doesn't support setting its power on brightness", *c.device.deviceInfo.IeeeAddress)
+		if cfg.PowerOn.RestoreLastState {
+			c.device.onRejoin(c.restoreLastCommanded)
+		}
+		return
+	}
+
+	err := c.setStartUpAttribute(ClusterIDLevel, LevelAttributeStartUpCurrentLevel, gateway.GwZclAttributeDataTypesT_ZCL_DATATYPE_UINT8, []byte{value})
+	if err != nil {
+		log.Infof("Failed to set power on brightness of device %X: %s", *c.device.deviceInfo.IeeeAddress, err)
+	}
+}
+
+func (c *BrightnessChannel) restoreLastCommanded() {
+	if c.lastCommanded == nil {
+		return
+	}
+	log.Infof("Restoring brightness of device %X to %f", *c.device.deviceInfo.IeeeAddress, *c.lastCommanded)
+
+	if err := c.SetBrightness(*c.lastCommanded); err != nil {
+		log.Warningf("Failed to restore brightness: %s", err)
+	}
+}
+
+func (c *ColorChannel) configurePowerOn() {
+	cfg, ok := c.device.config()
+	if !ok || cfg.PowerOn == nil {
+		return
+	}
+
+	var value uint32
+	switch {
+	case cfg.PowerOn.ColorTemperature != nil:
+		value = *cfg.PowerOn.ColorTemperature
+	case cfg.PowerOn.RestoreLastState:
+		value = 0xFFFF
+	default:
+		return
+	}
+
+	if !c.startUpSupported(ClusterIDColor, ColorAttributeStartUpColorTemperatureMireds) {
+		log.Infof("Device %X doesn't support setting its power on color", *c.device.deviceInfo.IeeeAddress)
+		if cfg.PowerOn.RestoreLastState {
+			c.device.onRejoin(c.restoreLastCommanded)
+		}
+		return
+	}
+
+	err := c.setStartUpAttribute(ClusterIDColor, ColorAttributeStartUpColorTemperatureMireds, gateway.GwZclAttributeDataTypesT_ZCL_DATATYPE_UINT16, uint16Bytes(value))
+	if err != nil {
+		log.Infof("Failed to set power on color of device %X: %s", *c.device.deviceInfo.IeeeAddress, err)
+	}
+}
+
+func (c *ColorChannel) restoreLastCommanded() {
+	if c.lastCommanded == nil {
+		return
+	}
+	log.Infof("Restoring color of device %X", *c.device.deviceInfo.IeeeAddress)
+
+	if err := c.SetColor(c.lastCommanded); err != nil {
+		log.Warningf("Failed to restore color: %s", err)
+	}
+}
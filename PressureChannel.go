@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/ninjasphere/go-zigbee/gateway"
+)
+
+// PressureChannel publishes the pressure measured by a sensor, in hPa.
+type PressureChannel struct {
+	Channel
+	channel *measurementChannel
+}
+
+func init() {
+	registerClusterHandler(&clusterHandler{
+		name:      "pressure",
+		clusterID: ClusterIDPressure,
+		direction: clusterInput,
+		newChannel: func(channel Channel) clusterChannel {
+			return &PressureChannel{Channel: channel}
+		},
+	})
+}
+
+// Attributes of the Pressure Measurement cluster. Sensors with more precision than the MeasuredValue (0.1 kPa)
+// also have the extended ScaledValue, which is in 10^Scale kPa.
+const (
+	PressureAttributeMeasuredValue uint32 = 0x0000
+	PressureAttributeScaledValue   uint32 = 0x0010
+	PressureAttributeScale         uint32 = 0x0014
+)
+
+func (c *PressureChannel) init() error {
+	log.Debugf("Initialising Pressure channel of device %d", *c.device.deviceInfo.IeeeAddress)
+
+	c.channel = &measurementChannel{protocol: "pressure"}
+	err := c.device.driver.Conn.ExportChannel(c.device, c.channel, c.ID)
+	if err != nil {
+		log.Fatalf("Failed to announce pressure channel: %s", err)
+	}
+
+	var state float64
+	if c.cachedState(&state) {
+		sendCachedState(c.channel.SendEvent, state)
+	}
+
+	go func() {
+		c.device.driver.waitUntilReady()
+		c.enableReporting()
+
+		for {
+			err := c.fetchState()
+			if err != nil {
+				log.Errorf("Failed to poll for Pressure %s", err)
+			}
+			time.Sleep(1 * time.Minute)
+		}
+	}()
+
+	return nil
+}
+
+func (c *PressureChannel) enableReporting() {
+
+	clusterID := ClusterIDPressure
+	measuredValueAttributeID := PressureAttributeMeasuredValue
+	minReportInterval := uint32(10)
+	maxReportInterval := uint32(120)
+	reportableChange := uint32(1)
+
+	request := &gateway.GwSetAttributeReportingReq{
+		DstAddress: c.dstAddress(),
+		ClusterId:  &clusterID,
+		AttributeReportList: []*gateway.GwAttributeReportT{{
+			AttributeId:       &measuredValueAttributeID,
+			AttributeType:     gateway.GwZclAttributeDataTypesT_ZCL_DATATYPE_INT16.Enum(),
+			MinReportInterval: &minReportInterval,
+			MaxReportInterval: &maxReportInterval,
+			ReportableChange:  &reportableChange,
+		}},
+	}
+
+	response := &gateway.GwSetAttributeReportingRspInd{}
+	err := c.device.driver.gatewayConn.SendAsyncCommand(request, response, 20*time.Second)
+	if err != nil {
+		log.Errorf("Error enabling Pressure reporting: %s", err)
+	} else if response.Status.String() != "STATUS_SUCCESS" {
+		log.Errorf("Failed to enable Pressure reporting. status: %s", response.Status.String())
+	}
+}
+
+func (c *PressureChannel) fetchState() error {
+
+	attributes, err := c.readAttributes(ClusterIDPressure, PressureAttributeMeasuredValue, PressureAttributeScaledValue, PressureAttributeScale)
+	if err != nil {
+		return err
+	}
+
+	var state float64
+
+	scaled, hasScaled := attributes[PressureAttributeScaledValue]
+	scale, hasScale := attributes[PressureAttributeScale]
+	measured, hasMeasured := attributes[PressureAttributeMeasuredValue]
+
+	switch {
+	case hasScaled && hasScale && attributeInt(scaled) != -0x8000:
+		log.Debugf("Got Pressure value %d scale %d", attributeInt(scaled), attributeInt(scale))
+		state = float64(attributeInt(scaled)) * math.Pow(10, float64(attributeInt(scale))) * 10
+	case hasMeasured && attributeInt(measured) != -0x8000:
+		log.Debugf("Got Pressure value %d", attributeInt(measured))
+		state = float64(attributeInt(measured))
+	default:
+		return fmt.Errorf("Device returned no valid pressure")
+	}
+
+	c.channel.SendState(state)
+	c.cacheState(state)
+
+	return nil
+}
@@ -13,9 +13,49 @@ type TempChannel struct {
 	channel *channels.TemperatureChannel
 }
 
+func init() {
+	registerClusterHandler(&clusterHandler{
+		name:      "temperature",
+		clusterID: ClusterIDTemp,
+		direction: clusterInput,
+		newChannel: func(channel Channel) clusterChannel {
+			return &TempChannel{Channel: channel}
+		},
+	})
+}
+
 func (c *TempChannel) init() error {
 	log.Debugf("Initialising Temp channel of device %d", *c.device.deviceInfo.IeeeAddress)
 
+	c.channel = channels.NewTemperatureChannel(c)
+	err := c.device.driver.Conn.ExportChannel(c.device, c.channel, c.ID)
+	if err != nil {
+		log.Fatalf("Failed to announce temperature channel: %s", err)
+	}
+
+	var state float64
+	if c.cachedState(&state) {
+		sendCachedState(c.channel.SendEvent, state)
+	}
+
+	go func() {
+		c.device.driver.waitUntilReady()
+		c.enableReporting()
+
+		for {
+			err := c.fetchState()
+			if err != nil {
+				log.Errorf("Failed to poll for Temperature %s", err)
+			}
+			time.Sleep(1 * time.Minute)
+		}
+	}()
+
+	return nil
+}
+
+func (c *TempChannel) enableReporting() {
+
 	clusterID := ClusterIDTemp
 	instantaneousDemandAttributeID := uint32(0x0400)
 	minReportInterval := uint32(10)
@@ -23,12 +63,8 @@ func (c *TempChannel) init() error {
 	reportableChange := uint32(1)
 
 	request := &gateway.GwSetAttributeReportingReq{
-		DstAddress: &gateway.GwAddressStructT{
-			AddressType: gateway.GwAddressTypeT_UNICAST.Enum(),
-			IeeeAddr:    c.device.deviceInfo.IeeeAddress,
-			EndpointId:  c.endpoint.EndpointId,
-		},
-		ClusterId: &clusterID,
+		DstAddress: c.dstAddress(),
+		ClusterId:  &clusterID,
 		AttributeReportList: []*gateway.GwAttributeReportT{{
 			AttributeId:       &instantaneousDemandAttributeID,
 			AttributeType:     gateway.GwZclAttributeDataTypesT_ZCL_DATATYPE_INT24.Enum(),
@@ -45,33 +81,12 @@ func (c *TempChannel) init() error {
 	} else if response.Status.String() != "STATUS_SUCCESS" {
 		log.Errorf("Failed to enable Temp reporting. status: %s", response.Status.String())
 	}
-
-	c.channel = channels.NewTemperatureChannel(c)
-	err = c.device.driver.Conn.ExportChannel(c.device, c.channel, c.ID)
-	if err != nil {
-		log.Fatalf("Failed to announce temperature channel: %s", err)
-	}
-
-	go func() {
-		for {
-			err := c.fetchState()
-			if err != nil {
-				log.Errorf("Failed to poll for Temperature %s", err)
-			}
-			time.Sleep(1 * time.Minute)
-		}
-	}()
-
-	return nil
 }
 
 func (c *TempChannel) fetchState() error {
 
 	request := &gateway.DevGetTempReq{
-		DstAddress: &gateway.GwAddressStructT{
-			AddressType: gateway.GwAddressTypeT_UNICAST.Enum(),
-			IeeeAddr:    c.device.deviceInfo.IeeeAddress,
-		},
+		DstAddress: c.dstAddress(),
 	}
 
 	response := &gateway.DevGetTempRspInd{}
@@ -85,7 +100,9 @@ func (c *TempChannel) fetchState() error {
 
 	log.Debugf("Got Temp value %d", *response.TemperatureValue)
 
-	c.channel.SendState(float64(*response.TemperatureValue) / 100)
+	state := float64(*response.TemperatureValue) / 100
+	c.channel.SendState(state)
+	c.cacheState(state)
 
 	return nil
 }
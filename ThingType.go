@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/ninjasphere/go-zigbee/nwkmgr"
+)
+
+const (
+	ProfileIDHA  uint32 = 0x0104
+	ProfileIDZLL uint32 = 0xC05E
+)
+
+// The ninja thing type of each ZLL device ID
+var zllThingTypes = map[uint32]string{
+	0x0000: "light",  // On/Off Light
+	0x0010: "socket", // On/Off Plug-in Unit
+	0x0100: "light",  // Dimmable Light
+	0x0110: "socket", // Dimmable Plug-in Unit
+	0x0200: "light",  // Color Light
+	0x0210: "light",  // Extended Color Light
+	0x0220: "light",  // Color Temperature Light
+	0x0800: "remote", // Color Controller
+	0x0810: "remote", // Color Scene Controller
+	0x0820: "remote", // Non-Color Controller
+	0x0830: "remote", // Non-Color Scene Controller
+	0x0840: "remote", // Control Bridge
+	0x0850: "remote", // On/Off Sensor
+}
+
+// The ninja thing type of each HA device ID. IAS Zones (0x0402) are classified by their zone type.
+var haThingTypes = map[uint32]string{
+	0x0000: "switch",     // On/Off Switch
+	0x0001: "switch",     // Level Control Switch
+	0x0002: "socket",     // On/Off Output
+	0x0003: "socket",     // Level Controllable Output
+	0x0006: "remote",     // Remote Control
+	0x0009: "socket",     // Mains Power Outlet
+	0x000A: "lock",       // Door Lock
+	0x000B: "remote",     // Door Lock Controller
+	0x0051: "socket",     // Smart Plug
+	0x0100: "light",      // On/Off Light
+	0x0101: "light",      // Dimmable Light
+	0x0102: "light",      // Color Dimmable Light
+	0x0103: "switch",     // On/Off Light Switch
+	0x0104: "switch",     // Dimmer Switch
+	0x0105: "switch",     // Color Dimmer Switch
+	0x0106: "sensor",     // Light Sensor
+	0x0107: "motion",     // Occupancy Sensor
+	0x010C: "light",      // Color Temperature Light
+	0x010D: "light",      // Extended Color Light
+	0x0202: "blind",      // Window Covering
+	0x0203: "remote",     // Window Covering Controller
+	0x0300: "thermostat", // Heating/Cooling Unit
+	0x0301: "thermostat", // Thermostat
+	0x0302: "sensor",     // Temperature Sensor
+	0x0401: "remote",     // IAS Ancillary Control Equipment
+	0x0403: "siren",      // IAS Warning Device
+}
+
+// The ninja thing type of each IAS zone type
+var zoneThingTypes = map[uint32]string{
+	0x0000: "alarm",   // Standard CIE
+	0x000D: "motion",  // Motion Sensor
+	0x0015: "contact", // Contact Switch
+	0x0028: "smoke",   // Fire Sensor
+	0x002A: "leak",    // Water Sensor
+	0x002B: "gas",     // Carbon Monoxide Sensor
+	0x002C: "button",  // Personal Emergency Device
+	0x002D: "sensor",  // Vibration/Movement Sensor
+	0x010F: "remote",  // Remote Control
+	0x0115: "remote",  // Key Fob
+	0x021D: "remote",  // Keypad
+	0x0225: "siren",   // Standard Warning Device
+	0x0226: "sensor",  // Glass Break Sensor
+}
+
+// endpointThingType returns the ninja thing type of an endpoint, falling back to guessing it from the
+// endpoint's clusters if knownThingType can't find it.
+func (d *Device) endpointThingType(endpoint *nwkmgr.NwkSimpleDescriptorT) string {
+	if thingType := d.knownThingType(endpoint); thingType != "" {
+		return thingType
+	}
+	return clusterThingType(endpoint)
+}
+
+// knownThingType returns the ninja thing type of an endpoint, or "" if we don't know it. In order, it comes
+// from the device's config, the config of its model, the endpoint's device ID and the IAS zone type.
+func (d *Device) knownThingType(endpoint *nwkmgr.NwkSimpleDescriptorT) string {
+
+	cfg, _ := d.config()
+	if cfg.ThingType != "" {
+		return cfg.ThingType
+	}
+
+	if thingType := d.driver.modelConfig(d.ModelIdentifier).ThingType; thingType != "" {
+		return thingType
+	}
+
+	switch endpoint.GetProfileId() {
+	case ProfileIDZLL:
+		if thingType, ok := zllThingTypes[endpoint.GetDeviceId()]; ok {
+			return thingType
+		}
+	case ProfileIDHA:
+		if thingType, ok := haThingTypes[endpoint.GetDeviceId()]; ok {
+			return thingType
+		}
+	}
+
+	if zoneType, ok := cfg.ZoneTypes[fmt.Sprintf("%d", endpoint.GetEndpointId())]; ok {
+		if thingType, ok := zoneThingTypes[zoneType]; ok {
+			return thingType
+		}
+	}
+
+	return ""
+}
+
+// clusterThingType guesses the thing type of an endpoint with an unknown device ID from the clusters it has.
+func clusterThingType(endpoint *nwkmgr.NwkSimpleDescriptorT) string {
+	has := func(clusterID uint32) bool {
+		return containsUInt32(endpoint.InputClusters, clusterID)
+	}
+
+	switch {
+	case has(ClusterIDColor):
+		return "light"
+	case has(ClusterIDThermostat):
+		return "thermostat"
+	case has(ClusterIDDoorLock):
+		return "lock"
+	case has(ClusterIDWindowCovering):
+		return "blind"
+	case has(ClusterIDOnOff) && has(ClusterIDLevel):
+		return "light"
+	case has(ClusterIDOnOff):
+		return "socket"
+	case has(ClusterIDIASWD):
+		return "siren"
+	case has(ClusterIDOccupancy):
+		return "motion"
+	case has(ClusterIDIASZone):
+		return "sensor"
+	case has(ClusterIDTemp), has(ClusterIDHumidity), has(ClusterIDIlluminance), has(ClusterIDPressure), has(ClusterIDFlow):
+		return "sensor"
+	case containsUInt32(endpoint.OutputClusters, ClusterIDIASACE):
+		return "remote"
+	case containsUInt32(endpoint.OutputClusters, ClusterIDOnOff):
+		return "switch"
+	}
+
+	return ""
+}
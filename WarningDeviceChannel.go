@@ -0,0 +1,212 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/ninjasphere/go-zigbee/gateway"
+)
+
+// WarningDeviceChannel controls a siren (IAS WD cluster). The state is the maximum duration of a warning.
+type WarningDeviceChannel struct {
+	Channel
+	SendEvent func(event string, payload ...interface{}) error
+}
+
+func init() {
+	registerClusterHandler(&clusterHandler{
+		name:      "ias-wd",
+		clusterID: ClusterIDIASWD,
+		direction: clusterInput,
+		newChannel: func(channel Channel) clusterChannel {
+			return &WarningDeviceChannel{Channel: channel}
+		},
+	})
+}
+
+// Commands and attributes of the IAS WD cluster
+const (
+	IASWDCommandStartWarning uint32 = 0x00
+	IASWDCommandSquawk       uint32 = 0x01
+
+	IASWDAttributeMaxDuration uint32 = 0x0000
+)
+
+// StartWarning starts (or, with mode "stop", stops) the siren and strobe.
+type StartWarning struct {
+	Mode        string  `json:"mode"`                  // "stop", "burglar", "fire", "emergency", "police-panic", "fire-panic" or "emergency-panic"
+	Strobe      bool    `json:"strobe,omitempty"`      // flash the strobe along with the siren
+	SirenLevel  string  `json:"sirenLevel,omitempty"`  // "low" (default), "medium", "high" or "very-high"
+	Duration    float64 `json:"duration"`              // seconds
+	StrobeDuty  *int    `json:"strobeDuty,omitempty"`  // percent of each second that the strobe is on, in steps of 10
+	StrobeLevel string  `json:"strobeLevel,omitempty"` // "low" (default), "medium", "high" or "very-high"
+}
+
+// Squawk makes the short sound used to confirm the system has been armed or disarmed.
+type Squawk struct {
+	Mode        string `json:"mode"`                  // "armed" or "disarmed"
+	Strobe      bool   `json:"strobe,omitempty"`      // flash the strobe along with the squawk
+	SquawkLevel string `json:"squawkLevel,omitempty"` // "low" (default), "medium", "high" or "very-high"
+}
+
+// WarningDeviceState is sent as the channel's state
+type WarningDeviceState struct {
+	MaxDuration float64 `json:"maxDuration"` // seconds
+}
+
+var warningModes = map[string]byte{
+	"stop":            0x0,
+	"burglar":         0x1,
+	"fire":            0x2,
+	"emergency":       0x3,
+	"police-panic":    0x4,
+	"fire-panic":      0x5,
+	"emergency-panic": 0x6,
+}
+
+var squawkModes = map[string]byte{
+	"armed":    0x0,
+	"disarmed": 0x1,
+}
+
+var warningLevels = map[string]byte{
+	"":          0x0,
+	"low":       0x0,
+	"medium":    0x1,
+	"high":      0x2,
+	"very-high": 0x3,
+}
+
+func (c *WarningDeviceChannel) SetEventHandler(handler func(event string, payload ...interface{}) error) {
+	c.SendEvent = handler
+}
+
+func (c *WarningDeviceChannel) GetProtocol() string {
+	return "warning-device"
+}
+
+func (c *WarningDeviceChannel) init() error {
+	log.Debugf("Initialising warning device channel of device %X", *c.device.deviceInfo.IeeeAddress)
+
+	err := c.device.driver.Conn.ExportChannel(c.device, c, c.ID)
+	if err != nil {
+		log.Fatalf("Failed to announce warning device channel: %s", err)
+	}
+
+	state := &WarningDeviceState{}
+	if c.cachedState(state) {
+		sendCachedState(c.SendEvent, state)
+	}
+
+	go func() {
+		c.device.driver.waitUntilReady()
+
+		if err := c.fetchState(); err != nil {
+			log.Warningf("Failed to get max duration of warning device %X: %s", *c.device.deviceInfo.IeeeAddress, err)
+		}
+	}()
+
+	return nil
+}
+
+func (c *WarningDeviceChannel) StartWarning(params *StartWarning) error {
+
+	mode, ok := warningModes[params.Mode]
+	if !ok {
+		return fmt.Errorf("Unknown warning mode '%s'", params.Mode)
+	}
+	sirenLevel, ok := warningLevels[params.SirenLevel]
+	if !ok {
+		return fmt.Errorf("Unknown siren level '%s'", params.SirenLevel)
+	}
+	strobeLevel, ok := warningLevels[params.StrobeLevel]
+	if !ok {
+		return fmt.Errorf("Unknown strobe level '%s'", params.StrobeLevel)
+	}
+
+	strobe := byte(0)
+	if params.Strobe {
+		strobe = 1
+	}
+
+	duty := 50
+	if params.StrobeDuty != nil {
+		duty = *params.StrobeDuty
+	}
+	if duty < 0 || duty > 100 {
+		return fmt.Errorf("Strobe duty must be between 0 and 100")
+	}
+
+	// The duration is a uint16 of seconds
+	if !(params.Duration >= 0 && params.Duration <= 0xFFFF) {
+		return fmt.Errorf("Duration must be between 0 and %d seconds", 0xFFFF)
+	}
+
+	state := &WarningDeviceState{}
+	if c.cachedState(state) && params.Duration > state.MaxDuration {
+		return fmt.Errorf("Duration is longer than the device's max duration of %.0f seconds", state.MaxDuration)
+	}
+
+	payload := []byte{mode<<4 | strobe<<2 | sirenLevel}
+	payload = append(payload, uint16Bytes(uint32(params.Duration))...)
+	payload = append(payload, byte(duty/10*10), strobeLevel)
+
+	log.Infof("Starting %s warning on device %X for %.0f seconds", params.Mode, *c.device.deviceInfo.IeeeAddress, params.Duration)
+
+	return c.sendCommand(ClusterIDIASWD, IASWDCommandStartWarning, payload)
+}
+
+func (c *WarningDeviceChannel) Squawk(params *Squawk) error {
+
+	mode, ok := squawkModes[params.Mode]
+	if !ok {
+		return fmt.Errorf("Unknown squawk mode '%s'", params.Mode)
+	}
+	level, ok := warningLevels[params.SquawkLevel]
+	if !ok {
+		return fmt.Errorf("Unknown squawk level '%s'", params.SquawkLevel)
+	}
+
+	strobe := byte(0)
+	if params.Strobe {
+		strobe = 1
+	}
+
+	return c.sendCommand(ClusterIDIASWD, IASWDCommandSquawk, []byte{mode<<4 | strobe<<3 | level})
+}
+
+// SetMaxDuration sets the longest a warning can sound for, in seconds.
+func (c *WarningDeviceChannel) SetMaxDuration(seconds float64) error {
+
+	if !(seconds >= 0 && seconds <= 0xFFFE) {
+		return fmt.Errorf("Max duration must be between 0 and %d seconds", 0xFFFE)
+	}
+
+	err := c.writeAttribute(ClusterIDIASWD, IASWDAttributeMaxDuration, gateway.GwZclAttributeDataTypesT_ZCL_DATATYPE_UINT16, uint16Bytes(uint32(seconds)))
+	if err != nil {
+		return err
+	}
+
+	return c.fetchState()
+}
+
+func (c *WarningDeviceChannel) fetchState() error {
+
+	attributes, err := c.readAttributes(ClusterIDIASWD, IASWDAttributeMaxDuration)
+	if err != nil {
+		return err
+	}
+
+	attribute, ok := attributes[IASWDAttributeMaxDuration]
+	if !ok {
+		return fmt.Errorf("Max duration was not returned")
+	}
+
+	state := &WarningDeviceState{
+		MaxDuration: float64(attributeUint(attribute)),
+	}
+
+	c.SendEvent("state", state)
+	c.cacheState(state)
+
+	return nil
+}
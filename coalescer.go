@@ -0,0 +1,186 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// How long to wait after the last of a burst of set requests before reading back the real state.
+const confirmDelay = 2 * time.Second
+
+// coalescer sends set requests for a channel one at a time, latest wins. Any request that arrives
+// while an earlier one is still being sent replaces whatever was waiting behind it, so a dragged
+// slider results in only a few commands rather than a queue of them.
+// Once a burst is over, confirm is called to read back the actual state of the device. If a send fails,
+// restore puts back the last state confirmed by the device.
+//
+// State is published with the coalescer's lock held, so that state read by a poll can't overwrite the state
+// of a request submitted while the read was in progress.
+type coalescer struct {
+	sync.Mutex
+	name    string
+	confirm func() error
+	restore func()
+	pending *setRequest
+	sending bool
+	done    chan struct{} // closed when the current burst has been sent
+	timer   *time.Timer
+	version uint64 // incremented by every change made to the state other than by a poll
+}
+
+// setRequest is a request waiting to be sent. When it is replaced, its waiters are passed on to the request
+// that replaced it, as that is the command that decides the state they asked for.
+type setRequest struct {
+	send    func() error
+	waiters []chan error
+}
+
+func newCoalescer(name string, confirm func() error, restore func()) *coalescer {
+	return &coalescer{
+		name:    name,
+		confirm: confirm,
+		restore: restore,
+	}
+}
+
+// submit publishes the state a request will set (optimistically, before it is sent) and queues send, replacing
+// any request that hasn't been sent yet. It waits for the result of the command that was sent in its place.
+func (c *coalescer) submit(publish func(), send func() error) error {
+	result := make(chan error, 1)
+
+	c.Lock()
+
+	c.version++
+	if publish != nil {
+		publish()
+	}
+
+	request := &setRequest{send: send, waiters: []chan error{result}}
+	if c.pending != nil {
+		request.waiters = append(c.pending.waiters, result)
+	}
+	c.pending = request
+
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+
+	if !c.sending {
+		c.sending = true
+		c.done = make(chan struct{})
+		go c.run()
+	}
+
+	c.Unlock()
+
+	return <-result
+}
+
+// cancel drops the request that hasn't been sent yet, if any, e.g. when a batch update has made it out of date,
+// and waits for a request that is already being sent so that it can't land after whatever replaces it.
+func (c *coalescer) cancel() {
+	c.Lock()
+
+	if c.pending != nil {
+		for _, waiter := range c.pending.waiters {
+			waiter <- nil
+		}
+		c.pending = nil
+	}
+
+	var done chan struct{}
+	if c.sending {
+		done = c.done
+	}
+
+	c.Unlock()
+
+	if done != nil {
+		<-done
+	}
+}
+
+// update publishes a change of state made outside of the coalescer (e.g. by a batch command), so that polls
+// already in progress don't overwrite it.
+func (c *coalescer) update(publish func()) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.version++
+	publish()
+}
+
+// busy returns true while a burst is being sent or is waiting to be confirmed. Polling should
+// not publish state read during this time, as it is likely to be out of date.
+func (c *coalescer) busy() bool {
+	c.Lock()
+	defer c.Unlock()
+	return c.sending || c.timer != nil
+}
+
+// current returns the version of the state, to be passed to publishRead once the state has been read.
+func (c *coalescer) current() uint64 {
+	c.Lock()
+	defer c.Unlock()
+	return c.version
+}
+
+// publishRead publishes state read from the device, unless a request has been submitted since the read started
+// (version) or is still being sent or confirmed.
+func (c *coalescer) publishRead(version uint64, publish func()) bool {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.version != version || c.sending {
+		return false
+	}
+	publish()
+	return true
+}
+
+func (c *coalescer) run() {
+	for {
+		c.Lock()
+		request := c.pending
+		c.pending = nil
+		if request == nil {
+			c.sending = false
+			close(c.done)
+			c.timer = time.AfterFunc(confirmDelay, c.confirmState)
+			c.Unlock()
+			return
+		}
+		c.Unlock()
+
+		err := request.send()
+		if err != nil {
+			log.Warningf("Failed to set %s: %s", c.name, err)
+
+			// Unless a newer request will replace it, the state we published for this one is wrong
+			c.Lock()
+			if c.pending == nil && c.restore != nil {
+				c.version++
+				c.restore()
+			}
+			c.Unlock()
+		}
+		for _, waiter := range request.waiters {
+			waiter <- err
+		}
+	}
+}
+
+func (c *coalescer) confirmState() {
+	c.Lock()
+	if c.sending {
+		c.Unlock()
+		return
+	}
+	c.timer = nil
+	c.Unlock()
+
+	if err := c.confirm(); err != nil {
+		log.Warningf("Failed to confirm %s state: %s", c.name, err)
+	}
+}
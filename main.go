@@ -17,12 +17,14 @@ var (
 		GatewayPort:    2541,
 		NwkmgrPort:     2540,
 		StableFlagFile: "/var/run/zigbee.stable", // TODO
+		StateFile:      "/data/zigbee-state.json",
 	}
 )
 
 func main() {
 	config.StableFlagFile = nconfig.String("/var/run/zigbee.stable", "zigbee", "stable-file")
 	config.Hostname = nconfig.String("localhost", "zigbee", "host")
+	config.StateFile = nconfig.String("/data/zigbee-state.json", "zigbee", "state-file")
 
 	check, err := os.Open("/etc/disable-zigbee")
 	if err != nil {
@@ -0,0 +1,395 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sync/atomic"
+	"time"
+
+	"github.com/ninjasphere/go-zigbee/gateway"
+	"github.com/ninjasphere/go-zigbee/nwkmgr"
+)
+
+// The endpoint on the gateway that we send from (and bind to).
+const localEndpointID uint32 = 5
+
+// The default transition used for level and color changes, in 1/10ths of a second.
+const defaultTransitionTime uint32 = 10
+
+// Level Control cluster commands
+const (
+	LevelCommandMoveToLevel          uint32 = 0x00
+	LevelCommandMove                 uint32 = 0x01
+	LevelCommandStep                 uint32 = 0x02
+	LevelCommandStop                 uint32 = 0x03
+	LevelCommandMoveToLevelWithOnOff uint32 = 0x04
+	LevelCommandMoveWithOnOff        uint32 = 0x05
+	LevelCommandStepWithOnOff        uint32 = 0x06
+	LevelCommandStopWithOnOff        uint32 = 0x07
+)
+
+// On/Off cluster commands
+const (
+	OnOffCommandOffWithEffect  uint32 = 0x40
+	OnOffCommandOnWithTimedOff uint32 = 0x42
+)
+
+// The profile wide command a device sends its attribute reports with
+const zclCommandReportAttributes uint32 = 0x0A
+
+// zclDataType is how a ZCL data type (as it appears in a frame) is decoded
+type zclDataType struct {
+	dataType gateway.GwZclAttributeDataTypesT
+	size     int // in bytes, or 0 for strings, which have a length prefix
+}
+
+// The ZCL data types we can decode from attribute reports, by their ZCL ID
+var zclDataTypes = map[byte]zclDataType{
+	0x10: {gateway.GwZclAttributeDataTypesT_ZCL_DATATYPE_BOOLEAN, 1},
+	0x18: {gateway.GwZclAttributeDataTypesT_ZCL_DATATYPE_BITMAP8, 1},
+	0x19: {gateway.GwZclAttributeDataTypesT_ZCL_DATATYPE_BITMAP16, 2},
+	0x20: {gateway.GwZclAttributeDataTypesT_ZCL_DATATYPE_UINT8, 1},
+	0x21: {gateway.GwZclAttributeDataTypesT_ZCL_DATATYPE_UINT16, 2},
+	0x22: {gateway.GwZclAttributeDataTypesT_ZCL_DATATYPE_UINT24, 3},
+	0x23: {gateway.GwZclAttributeDataTypesT_ZCL_DATATYPE_UINT32, 4},
+	0x25: {gateway.GwZclAttributeDataTypesT_ZCL_DATATYPE_UINT48, 6},
+	0x28: {gateway.GwZclAttributeDataTypesT_ZCL_DATATYPE_INT8, 1},
+	0x29: {gateway.GwZclAttributeDataTypesT_ZCL_DATATYPE_INT16, 2},
+	0x2A: {gateway.GwZclAttributeDataTypesT_ZCL_DATATYPE_INT24, 3},
+	0x2B: {gateway.GwZclAttributeDataTypesT_ZCL_DATATYPE_INT32, 4},
+	0x30: {gateway.GwZclAttributeDataTypesT_ZCL_DATATYPE_ENUM8, 1},
+	0x31: {gateway.GwZclAttributeDataTypesT_ZCL_DATATYPE_ENUM16, 2},
+	0x39: {gateway.GwZclAttributeDataTypesT_ZCL_DATATYPE_SINGLE_PREC, 4},
+	0x3A: {gateway.GwZclAttributeDataTypesT_ZCL_DATATYPE_DOUBLE_PREC, 8},
+	0x42: {gateway.GwZclAttributeDataTypesT_ZCL_DATATYPE_CHAR_STR, 0},
+	0xF0: {gateway.GwZclAttributeDataTypesT_ZCL_DATATYPE_IEEE_ADDR, 8},
+}
+
+// Color Control cluster commands
+const (
+	ColorCommandMoveToHueAndSaturation uint32 = 0x06
+)
+
+var zclSequenceNumber uint32
+
+// sendCommand sends a cluster specific ZCL command to the channel's endpoint.
+func (c *Channel) sendCommand(clusterID uint32, commandID uint32, payload []byte) error {
+	sequenceNumber := atomic.AddUint32(&zclSequenceNumber, 1) & 0xFF
+	return c.sendFrame(clusterID, commandID, gateway.GwClientServerDirT_CLIENT_TO_SERVER, sequenceNumber, payload)
+}
+
+// sendResponse sends a cluster specific ZCL command in response to a command the device sent us, using its
+// sequence number and going the other way across the cluster.
+func (c *Channel) sendResponse(request *gateway.GwZclFrameReceiveInd, commandID uint32, payload []byte) error {
+	direction := gateway.GwClientServerDirT_SERVER_TO_CLIENT
+	if request.GetClientServerDirection() == gateway.GwClientServerDirT_SERVER_TO_CLIENT {
+		direction = gateway.GwClientServerDirT_CLIENT_TO_SERVER
+	}
+	return c.sendFrame(request.GetClusterId(), commandID, direction, request.GetSequenceNumber(), payload)
+}
+
+func (c *Channel) sendFrame(clusterID uint32, commandID uint32, direction gateway.GwClientServerDirT, sequenceNumber uint32, payload []byte) error {
+	c.device.driver.waitUntilReady()
+
+	sourceEndpoint := localEndpointID
+
+	request := &gateway.GwSendZclFrameReq{
+		DstAddress:               c.dstAddress(),
+		EndpointIdSource:         &sourceEndpoint,
+		ProfileId:                c.endpoint.ProfileId,
+		QualityOfService:         gateway.GwQualityOfServiceT_APS_ACK.Enum(),
+		SequenceNumber:           &sequenceNumber,
+		ClusterId:                &clusterID,
+		FrameType:                gateway.GwFrameTypeT_FRAME_CLUSTER_SPECIFIC.Enum(),
+		ManufacturerSpecificFlag: gateway.GwMfrSpecificFlagT_NON_MFR_SPECIFIC.Enum(),
+		ClientServerDirection:    direction.Enum(),
+		DisableDefaultRsp:        gateway.GwDisableDefaultRspT_DEFAULT_RSP_ENABLED.Enum(),
+		CommandId:                &commandID,
+		Payload:                  payload,
+	}
+
+	response := &gateway.GwZigbeeGenericRspInd{}
+	err := c.device.driver.gatewayConn.SendAsyncCommand(request, response, 2*time.Second)
+	if err != nil {
+		return fmt.Errorf("Error sending command 0x%X to cluster 0x%X : %s", commandID, clusterID, err)
+	}
+	if response.Status.String() != "STATUS_SUCCESS" {
+		return fmt.Errorf("Failed to send command 0x%X to cluster 0x%X. status: %s", commandID, clusterID, response.Status.String())
+	}
+
+	return nil
+}
+
+// bindCluster binds one of the device's clusters to us, and returns the frames it sends us from it. It is used
+// for clusters where the device is the client, e.g. the on/off cluster of a switch, and for the attribute reports
+// of clusters that the gateway doesn't handle itself.
+func (c *Channel) bindCluster(clusterID uint32) chan *gateway.GwZclFrameReceiveInd {
+	c.device.driver.waitUntilReady()
+
+	dstEndpoint := localEndpointID
+
+	bindReq := &nwkmgr.NwkSetBindingEntryReq{
+		SrcAddr: &nwkmgr.NwkAddressStructT{
+			AddressType: nwkmgr.NwkAddressTypeT_UNICAST.Enum(),
+			IeeeAddr:    c.device.deviceInfo.IeeeAddress,
+			EndpointId:  c.endpoint.EndpointId,
+		},
+		ClusterId: &clusterID,
+		DstAddr: &nwkmgr.NwkAddressStructT{
+			AddressType: nwkmgr.NwkAddressTypeT_UNICAST.Enum(),
+			IeeeAddr:    c.device.driver.localDevice.IeeeAddress,
+			EndpointId:  &dstEndpoint,
+		},
+		BindingMode: nwkmgr.NwkBindingModeT_BIND.Enum(),
+	}
+
+	log.Infof("Binding cluster 0x%X %v", clusterID, bindReq)
+
+	bindRes := &nwkmgr.NwkSetBindingEntryRspInd{}
+
+	err := c.device.driver.nwkmgrConn.SendAsyncCommand(bindReq, bindRes, time.Second*10)
+	if err != nil {
+		log.Errorf("Error binding cluster 0x%X: %s", clusterID, err)
+	} else if bindRes.Status.String() != "STATUS_SUCCESS" {
+		log.Errorf("Failed to bind cluster 0x%X. status: %s", clusterID, bindRes.Status.String())
+	}
+
+	return c.device.driver.gatewayConn.OnBoundCluster(*c.device.deviceInfo.IeeeAddress, *c.endpoint.EndpointId, clusterID)
+}
+
+// readAttributes reads attributes of a cluster on the channel's endpoint, returning the records
+// that came back keyed by attribute ID. Unsupported attributes are simply missing from the result.
+func (c *Channel) readAttributes(clusterID uint32, attributeIDs ...uint32) (map[uint32]*gateway.GwAttributeRecordT, error) {
+	c.device.driver.waitUntilReady()
+
+	request := &gateway.GwReadDeviceAttributeReq{
+		DstAddress:    c.dstAddress(),
+		ClusterId:     &clusterID,
+		AttributeList: attributeIDs,
+	}
+
+	response := &gateway.GwReadDeviceAttributeRspInd{}
+	err := c.device.driver.gatewayConn.SendAsyncCommand(request, response, 10*time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading attributes of cluster 0x%X : %s", clusterID, err)
+	}
+	if response.Status.String() != "STATUS_SUCCESS" {
+		return nil, fmt.Errorf("Failed to read attributes of cluster 0x%X. status: %s", clusterID, response.Status.String())
+	}
+
+	records := make(map[uint32]*gateway.GwAttributeRecordT)
+	for _, record := range response.AttributeRecordList {
+		records[*record.AttributeId] = record
+	}
+
+	return records, nil
+}
+
+// writeAttribute writes a single attribute of a cluster on the channel's endpoint.
+func (c *Channel) writeAttribute(clusterID uint32, attributeID uint32, dataType gateway.GwZclAttributeDataTypesT, value []byte) error {
+	c.device.driver.waitUntilReady()
+
+	request := &gateway.GwWriteDeviceAttributeReq{
+		DstAddress: c.dstAddress(),
+		ClusterId:  &clusterID,
+		AttributeRecordList: []*gateway.GwAttributeRecordT{{
+			AttributeId:    &attributeID,
+			AttributeType:  dataType.Enum(),
+			AttributeValue: value,
+		}},
+	}
+
+	response := &gateway.GwWriteDeviceAttributeRspInd{}
+	err := c.device.driver.gatewayConn.SendAsyncCommand(request, response, 10*time.Second)
+	if err != nil {
+		return fmt.Errorf("Error writing attribute 0x%X of cluster 0x%X : %s", attributeID, clusterID, err)
+	}
+	if response.Status.String() != "STATUS_SUCCESS" {
+		return fmt.Errorf("Failed to write attribute 0x%X of cluster 0x%X. status: %s", attributeID, clusterID, response.Status.String())
+	}
+
+	for _, status := range response.AttributeStatusList {
+		if status.Status.String() != "ZCL_STATUS_SUCCESS" {
+			return fmt.Errorf("Failed to write attribute 0x%X of cluster 0x%X. status: %s", attributeID, clusterID, status.Status.String())
+		}
+	}
+
+	return nil
+}
+
+// parseAttributeReport reads the attribute records of a Report Attributes frame, keyed by attribute ID. Each is
+// the attribute ID (2 bytes), the ZCL data type and the value.
+func parseAttributeReport(frame *gateway.GwZclFrameReceiveInd) (map[uint32]*gateway.GwAttributeRecordT, error) {
+
+	attributes := make(map[uint32]*gateway.GwAttributeRecordT)
+
+	payload := frame.Payload
+	for len(payload) > 0 {
+		if len(payload) < 3 {
+			return nil, fmt.Errorf("Attribute report is truncated")
+		}
+
+		attributeID := uint32(payload[0]) | uint32(payload[1])<<8
+		dataType, ok := zclDataTypes[payload[2]]
+		if !ok {
+			// We can't tell where the next record starts, so keep what we have
+			log.Debugf("Unknown data type 0x%X of attribute 0x%X in report. Ignoring the rest of it", payload[2], attributeID)
+			break
+		}
+		payload = payload[3:]
+
+		size := dataType.size
+		if size == 0 && len(payload) > 0 {
+			size = int(payload[0]) + 1
+		}
+		if size == 0 || len(payload) < size {
+			return nil, fmt.Errorf("Value of attribute 0x%X in report is truncated", attributeID)
+		}
+
+		attributes[attributeID] = &gateway.GwAttributeRecordT{
+			AttributeId:    &attributeID,
+			AttributeType:  dataType.dataType.Enum(),
+			AttributeValue: payload[:size],
+		}
+		payload = payload[size:]
+	}
+
+	return attributes, nil
+}
+
+// attributeUint decodes an unsigned (or enum/bitmap) little endian attribute value
+func attributeUint(record *gateway.GwAttributeRecordT) uint64 {
+	var value uint64
+	for i, b := range record.AttributeValue {
+		if i >= 8 {
+			break
+		}
+		value |= uint64(b) << (8 * uint(i))
+	}
+	return value
+}
+
+// attributeInt decodes a signed little endian attribute value, of whatever width it was sent as
+func attributeInt(record *gateway.GwAttributeRecordT) int64 {
+	width := uint(len(record.AttributeValue))
+	if width == 0 || width >= 8 {
+		return int64(attributeUint(record))
+	}
+	shift := 64 - 8*width
+	return int64(attributeUint(record)<<shift) >> shift
+}
+
+// attributeString decodes a ZCL character string, which may still have its length prefix. Long strings have
+// a two byte prefix.
+func attributeString(record *gateway.GwAttributeRecordT) string {
+	value := record.AttributeValue
+	if record.GetAttributeType() == gateway.GwZclAttributeDataTypesT_ZCL_DATATYPE_LONG_CHAR_STR {
+		if len(value) > 1 && int(value[0])|int(value[1])<<8 == len(value)-2 {
+			return string(value[2:])
+		}
+	} else if len(value) > 0 && int(value[0]) == len(value)-1 {
+		return string(value[1:])
+	}
+	return cleanString(value)
+}
+
+// decodeAttribute converts an attribute value into the closest go type, for when we don't know
+// (or care) what the attribute means.
+func decodeAttribute(record *gateway.GwAttributeRecordT) interface{} {
+
+	switch *record.AttributeType {
+	case gateway.GwZclAttributeDataTypesT_ZCL_DATATYPE_BOOLEAN:
+		return attributeUint(record) != 0
+
+	case gateway.GwZclAttributeDataTypesT_ZCL_DATATYPE_UINT8,
+		gateway.GwZclAttributeDataTypesT_ZCL_DATATYPE_UINT16,
+		gateway.GwZclAttributeDataTypesT_ZCL_DATATYPE_UINT24,
+		gateway.GwZclAttributeDataTypesT_ZCL_DATATYPE_UINT32,
+		gateway.GwZclAttributeDataTypesT_ZCL_DATATYPE_UINT40,
+		gateway.GwZclAttributeDataTypesT_ZCL_DATATYPE_UINT48,
+		gateway.GwZclAttributeDataTypesT_ZCL_DATATYPE_UINT56,
+		gateway.GwZclAttributeDataTypesT_ZCL_DATATYPE_UINT64,
+		gateway.GwZclAttributeDataTypesT_ZCL_DATATYPE_ENUM8,
+		gateway.GwZclAttributeDataTypesT_ZCL_DATATYPE_ENUM16,
+		gateway.GwZclAttributeDataTypesT_ZCL_DATATYPE_BITMAP8,
+		gateway.GwZclAttributeDataTypesT_ZCL_DATATYPE_BITMAP16,
+		gateway.GwZclAttributeDataTypesT_ZCL_DATATYPE_BITMAP24,
+		gateway.GwZclAttributeDataTypesT_ZCL_DATATYPE_BITMAP32,
+		gateway.GwZclAttributeDataTypesT_ZCL_DATATYPE_UTC,
+		gateway.GwZclAttributeDataTypesT_ZCL_DATATYPE_CLUSTER_ID,
+		gateway.GwZclAttributeDataTypesT_ZCL_DATATYPE_ATTR_ID:
+		return attributeUint(record)
+
+	case gateway.GwZclAttributeDataTypesT_ZCL_DATATYPE_INT8,
+		gateway.GwZclAttributeDataTypesT_ZCL_DATATYPE_INT16,
+		gateway.GwZclAttributeDataTypesT_ZCL_DATATYPE_INT24,
+		gateway.GwZclAttributeDataTypesT_ZCL_DATATYPE_INT32,
+		gateway.GwZclAttributeDataTypesT_ZCL_DATATYPE_INT40,
+		gateway.GwZclAttributeDataTypesT_ZCL_DATATYPE_INT48,
+		gateway.GwZclAttributeDataTypesT_ZCL_DATATYPE_INT56,
+		gateway.GwZclAttributeDataTypesT_ZCL_DATATYPE_INT64:
+		return attributeInt(record)
+
+	case gateway.GwZclAttributeDataTypesT_ZCL_DATATYPE_SINGLE_PREC:
+		return finiteFloat(float64(math.Float32frombits(uint32(attributeUint(record)))))
+
+	case gateway.GwZclAttributeDataTypesT_ZCL_DATATYPE_DOUBLE_PREC:
+		return finiteFloat(math.Float64frombits(attributeUint(record)))
+
+	case gateway.GwZclAttributeDataTypesT_ZCL_DATATYPE_CHAR_STR,
+		gateway.GwZclAttributeDataTypesT_ZCL_DATATYPE_LONG_CHAR_STR:
+		return attributeString(record)
+
+	case gateway.GwZclAttributeDataTypesT_ZCL_DATATYPE_IEEE_ADDR:
+		return fmt.Sprintf("%X", attributeUint(record))
+	}
+
+	return fmt.Sprintf("% X", record.AttributeValue)
+}
+
+// finiteFloat returns nil for NaN and infinite values (which ZCL uses for invalid readings), as they can't be
+// encoded as JSON.
+func finiteFloat(value float64) interface{} {
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return nil
+	}
+	return value
+}
+
+// transitionTime converts a transition in milliseconds (as found in a batch update) into
+// the 1/10ths of a second used by ZCL, falling back to the default if none was given.
+func transitionTime(ms *int) uint32 {
+	if ms == nil {
+		return defaultTransitionTime
+	}
+	if *ms <= 0 {
+		return 0
+	}
+	if *ms/100 > 0xFFFE {
+		return 0xFFFE
+	}
+	return uint32(*ms / 100)
+}
+
+// toTenths converts seconds into the 1/10ths of a second used by ZCL timers, limited to 16 bits.
+func toTenths(seconds float64) uint32 {
+	if seconds <= 0 {
+		return 0
+	}
+	if seconds*10 > 0xFFFE {
+		return 0xFFFE
+	}
+	return uint32(seconds * 10)
+}
+
+func uint16Bytes(value uint32) []byte {
+	return []byte{byte(value), byte(value >> 8)}
+}
+
+func uint64Bytes(value uint64) []byte {
+	buf := make([]byte, 8)
+	for i := range buf {
+		buf[i] = byte(value >> uint(8*i))
+	}
+	return buf
+}